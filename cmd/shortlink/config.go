@@ -9,63 +9,198 @@ type config struct {
 	ListenAddr  string
 	StorageType string
 
+	// Comma separated domains, the first one is the default domain
+	Domains string
+
+	CodeNormalization string
+	CodeSuggestions   string
+
 	// MongoDB Storage
 	MongoDbUri string
 
 	// Badger storage
 	StoragePath string
 
+	TrashRetention string
+
+	RedirectStatus string
+
+	// Destination validation
+	AllowedSchemes string
+	AllowedHosts   string
+	DeniedHosts    string
+
+	// Destination health checks
+	HealthcheckInterval    string
+	HealthcheckTimeout     string
+	HealthcheckConcurrency string
+
+	// Native TLS
+	TLSCert         string
+	TLSKey          string
+	TLSRedirectAddr string
+
+	// ACME certificates
+	ACMEDomains     string
+	ACMEEmail       string
+	ACMEDirectory   string
+	ACMEDirectoryCA string
+
+	// Comma separated CIDRs of reverse proxies allowed to set forwarding headers
+	TrustedProxies string
+
+	// Rate limits per client
+	RedirectRateLimit string
+	MissRateLimit     string
+	LoginRateLimit    string
+	PasswordRateLimit string
+
+	// Secret for signing the cookies of password protected shortlinks
+	CookieSecret string
+	// Cookies without the Secure attribute for plain HTTP deployments without trusted proxies
+	CookiePlainHTTP string
+
 	AuthType string
 
 	// Basic auth
 	BasicAuthUser     string
 	BasicAuthPassword string
+	// File with additional users in the htpasswd format
+	BasicAuthUsersFile string
 
 	// OpenId Connect Auth
 	OidcIssuer       string
 	OidcClientId     string
 	OidcClientSecret string
 	OidcRedirectUri  string
+	OidcGroupsClaim  string
+
+	// Comma separated users and groups that may manage all codes and the namespaces
+	Admins string
 }
 
 func getConfig() config {
 	listenAddrFlag := flag.String("addr", ":8080", "Address and port to listen on")
+	codeNormalizationFlag := flag.String("codes.normalize", "", "Comma separated normalization steps applied to codes when saving and looking them up. Possible values: case, punctuation, unicode. Empty disables the normalization")
+	codeSuggestionsFlag := flag.String("codes.suggestions", "5", "Maximum number of similar codes suggested on the not found page, 0 disables the suggestions")
+	domainsFlag := flag.String("domains", "", "Comma separated list of domains with separate shortlinks, the first one is the default for unknown hosts and existing shortlinks. Empty serves the same shortlinks on all hosts")
 	storageTypeFlag := flag.String("storage.type", "mongodb", "Used storage type. Possible values: mongodb, local")
 	mongodbUrlFlag := flag.String("storage.mongodb.uri", "mongodb://localhost:27017/shortlink", "MongoDB URI to connect to when using MongoDB storage")
 	storagePathFlag := flag.String("storage.local.path", "./storage", "Storage path when using local storage")
+	trashRetentionFlag := flag.String("trash.retention", "720h", "Duration deleted shortlinks are kept in the trash before they are purged")
+	redirectStatusFlag := flag.String("redirect.status", "302", "Default HTTP status code for redirects. Possible values: 301, 302, 307, 308")
+	allowedSchemesFlag := flag.String("validation.schemes", "http,https", "Comma separated list of URL schemes allowed for destinations")
+	allowedHostsFlag := flag.String("validation.allowed-hosts", "", "Comma separated list of allowed destination hosts. Entries match the domain and its subdomains, entries prefixed with regex: are regular expressions. Empty allows all hosts")
+	deniedHostsFlag := flag.String("validation.denied-hosts", "", "Comma separated list of denied destination hosts, same format as validation.allowed-hosts")
+	healthcheckIntervalFlag := flag.String("healthcheck.interval", "0s", "Interval for checking whether destinations are reachable, 0s disables the checks")
+	healthcheckTimeoutFlag := flag.String("healthcheck.timeout", "10s", "Timeout for a single destination check")
+	healthcheckConcurrencyFlag := flag.String("healthcheck.concurrency", "4", "Number of destinations checked in parallel")
+	tlsCertFlag := flag.String("tls.cert", "", "PEM certificate file for serving HTTPS, it is reloaded when changed. Empty serves plain HTTP")
+	tlsKeyFlag := flag.String("tls.key", "", "PEM private key file for tls.cert")
+	tlsRedirectAddrFlag := flag.String("tls.redirect-addr", "", "Address and port of an additional plain HTTP listener redirecting to HTTPS, e.g. :80. Empty disables it")
+	acmeDomainsFlag := flag.String("acme.domains", "", "Comma separated list of domains to request certificates for via ACME, the certificates are stored in the configured storage. Requires tls.redirect-addr for HTTP-01 challenges. Empty disables ACME")
+	acmeEmailFlag := flag.String("acme.email", "", "Contact email address for the ACME account")
+	acmeDirectoryFlag := flag.String("acme.directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory URL")
+	acmeDirectoryCAFlag := flag.String("acme.directory-ca", "", "PEM file with additional CA certificates trusted for the ACME directory, e.g. for testing with Pebble")
+	trustedProxiesFlag := flag.String("proxy.trusted", "", "Comma separated list of reverse proxy addresses or CIDRs whose Forwarded and X-Forwarded-* headers are used for the client address and scheme")
+	redirectRateLimitFlag := flag.String("ratelimit.redirect", "20/s:40", "Rate limit for shortlink requests per client in the format <count>/<s|m|h>[:<burst>], off disables the limit")
+	missRateLimitFlag := flag.String("ratelimit.miss", "off", "Rate limit for requests of unknown shortlinks per client, e.g. 30/m:10, same format as ratelimit.redirect. Only enable it with proxy.trusted behind a reverse proxy, clients sharing an address share the limit")
+	loginRateLimitFlag := flag.String("ratelimit.login", "off", "Rate limit for failed basic auth logins per client, e.g. 10/m:5, same format as ratelimit.redirect. Only enable it with proxy.trusted behind a reverse proxy, clients sharing an address share the limit")
+	passwordRateLimitFlag := flag.String("ratelimit.password", "20/h:5", "Rate limit for wrong passwords of protected shortlinks per client and shortlink, same format as ratelimit.redirect")
+	cookieSecretFlag := flag.String("cookie.secret", "", "Secret for signing the cookies of password protected shortlinks, has to be the same for all replicas. A random secret is generated if empty")
+	cookiePlainHTTPFlag := flag.String("cookie.plain-http", "false", "Set cookies without the Secure attribute and the __Host- prefix on plain HTTP requests, for deployments without TLS. Otherwise this only happens for requests known to use plain HTTP through proxy.trusted")
 	authTypeFlag := flag.String("auth.type", "none", "Used authentication for admin area. Possible values: none, basic, oidc")
 	basicAuthUserFlag := flag.String("auth.basic.user", "admin", "Username for basic authentication")
 	basicAuthPasswordFlag := flag.String("auth.basic.password", "$2y$12$K7yP/8CraK8RB0yxvv2H4OI6jrC4ym.Xmzx9KQSvqSw3r.3gvtkRu", "Bcrypt password hash for basic authentication")
+	basicAuthUsersFileFlag := flag.String("auth.basic.users-file", "", "File with additional basic auth users in the htpasswd format, one user:bcrypt-hash per line")
 	oidcIssuerFlag := flag.String("auth.oidc.issuer", "https://idp.example.com", "OpenID Connect issuer used for autodiscovery")
 	oidcClientIdFlag := flag.String("auth.oidc.client-id", "client", "OpenID Connect Client ID")
 	oidcClientSecretFlag := flag.String("auth.oidc.client-secret", "secret", "OpenID Connect Client secret")
 	oidcRedirectUriFlag := flag.String("auth.oidc.redirect-uri", "https://shortlink.example.com/oauth2/callback", "Full redirect URI registered at the auth server, path has to be /oauth2/callback")
+	oidcGroupsClaimFlag := flag.String("auth.oidc.groups-claim", "groups", "ID token claim listing the groups of the user, used for namespace memberships")
+	adminsFlag := flag.String("auth.admins", "", "Comma separated users and groups (group:<name>) that may manage all codes and the namespaces. Other users only manage the codes of their namespaces. Empty makes every logged in user an admin")
 	flag.Parse()
 
 	listenAddrEnv := os.Getenv("LISTEN_ADDR")
+	codeNormalizationEnv := os.Getenv("CODES_NORMALIZE")
+	codeSuggestionsEnv := os.Getenv("CODES_SUGGESTIONS")
+	domainsEnv := os.Getenv("DOMAINS")
 	storageTypeEnv := os.Getenv("STORAGE_TYPE")
 	mongodbUrlEnv := os.Getenv("STORAGE_MONGODB_URI")
 	storagePathEnv := os.Getenv("STORAGE_LOCAL_PATH")
+	trashRetentionEnv := os.Getenv("TRASH_RETENTION")
+	redirectStatusEnv := os.Getenv("REDIRECT_STATUS")
+	allowedSchemesEnv := os.Getenv("VALIDATION_SCHEMES")
+	allowedHostsEnv := os.Getenv("VALIDATION_ALLOWED_HOSTS")
+	deniedHostsEnv := os.Getenv("VALIDATION_DENIED_HOSTS")
+	healthcheckIntervalEnv := os.Getenv("HEALTHCHECK_INTERVAL")
+	healthcheckTimeoutEnv := os.Getenv("HEALTHCHECK_TIMEOUT")
+	healthcheckConcurrencyEnv := os.Getenv("HEALTHCHECK_CONCURRENCY")
+	tlsCertEnv := os.Getenv("TLS_CERT")
+	tlsKeyEnv := os.Getenv("TLS_KEY")
+	tlsRedirectAddrEnv := os.Getenv("TLS_REDIRECT_ADDR")
+	acmeDomainsEnv := os.Getenv("ACME_DOMAINS")
+	acmeEmailEnv := os.Getenv("ACME_EMAIL")
+	acmeDirectoryEnv := os.Getenv("ACME_DIRECTORY")
+	acmeDirectoryCAEnv := os.Getenv("ACME_DIRECTORY_CA")
+	trustedProxiesEnv := os.Getenv("PROXY_TRUSTED")
+	redirectRateLimitEnv := os.Getenv("RATELIMIT_REDIRECT")
+	missRateLimitEnv := os.Getenv("RATELIMIT_MISS")
+	loginRateLimitEnv := os.Getenv("RATELIMIT_LOGIN")
+	passwordRateLimitEnv := os.Getenv("RATELIMIT_PASSWORD")
+	cookieSecretEnv := os.Getenv("COOKIE_SECRET")
+	cookiePlainHTTPEnv := os.Getenv("COOKIE_PLAIN_HTTP")
 	authTypeEnv := os.Getenv("AUTH_TYPE")
 	basicAuthUserEnv := os.Getenv("AUTH_BASIC_USER")
 	basicAuthPasswordEnv := os.Getenv("AUTH_BASIC_PASSWORD")
+	basicAuthUsersFileEnv := os.Getenv("AUTH_BASIC_USERS_FILE")
 	oidcIssuerEnv := os.Getenv("AUTH_OIDC_ISSUER")
 	oidcClientIdEnv := os.Getenv("AUTH_OIDC_CLIENTID")
 	oidcClientSecretEnv := os.Getenv("AUTH_OIDC_CLIENTSECRET")
 	oidcRedirectUriEnv := os.Getenv("AUTH_OIDC_REDIRECTURI")
+	oidcGroupsClaimEnv := os.Getenv("AUTH_OIDC_GROUPSCLAIM")
+	adminsEnv := os.Getenv("AUTH_ADMINS")
 
 	return config{
-		ListenAddr:        flagOrEnv(*listenAddrFlag, listenAddrEnv, ":8080"),
-		StorageType:       flagOrEnv(*storageTypeFlag, storageTypeEnv, "mongodb"),
-		MongoDbUri:        flagOrEnv(*mongodbUrlFlag, mongodbUrlEnv, "mongodb://localhost:27017/shortlink"),
-		StoragePath:       flagOrEnv(*storagePathFlag, storagePathEnv, "./storage"),
-		AuthType:          flagOrEnv(*authTypeFlag, authTypeEnv, "none"),
-		BasicAuthUser:     flagOrEnv(*basicAuthUserFlag, basicAuthUserEnv, "admin"),
-		BasicAuthPassword: flagOrEnv(*basicAuthPasswordFlag, basicAuthPasswordEnv, "$2y$12$K7yP/8CraK8RB0yxvv2H4OI6jrC4ym.Xmzx9KQSvqSw3r.3gvtkRu"),
-		OidcIssuer:        flagOrEnv(*oidcIssuerFlag, oidcIssuerEnv, "https://idp.example.com"),
-		OidcClientId:      flagOrEnv(*oidcClientIdFlag, oidcClientIdEnv, "client"),
-		OidcClientSecret:  flagOrEnv(*oidcClientSecretFlag, oidcClientSecretEnv, "secret"),
-		OidcRedirectUri:   flagOrEnv(*oidcRedirectUriFlag, oidcRedirectUriEnv, "https://shortlink.example.com/oauth2/callback"),
+		ListenAddr:             flagOrEnv(*listenAddrFlag, listenAddrEnv, ":8080"),
+		CodeNormalization:      flagOrEnv(*codeNormalizationFlag, codeNormalizationEnv, ""),
+		CodeSuggestions:        flagOrEnv(*codeSuggestionsFlag, codeSuggestionsEnv, "5"),
+		Domains:                flagOrEnv(*domainsFlag, domainsEnv, ""),
+		StorageType:            flagOrEnv(*storageTypeFlag, storageTypeEnv, "mongodb"),
+		MongoDbUri:             flagOrEnv(*mongodbUrlFlag, mongodbUrlEnv, "mongodb://localhost:27017/shortlink"),
+		StoragePath:            flagOrEnv(*storagePathFlag, storagePathEnv, "./storage"),
+		TrashRetention:         flagOrEnv(*trashRetentionFlag, trashRetentionEnv, "720h"),
+		RedirectStatus:         flagOrEnv(*redirectStatusFlag, redirectStatusEnv, "302"),
+		AllowedSchemes:         flagOrEnv(*allowedSchemesFlag, allowedSchemesEnv, "http,https"),
+		AllowedHosts:           flagOrEnv(*allowedHostsFlag, allowedHostsEnv, ""),
+		DeniedHosts:            flagOrEnv(*deniedHostsFlag, deniedHostsEnv, ""),
+		HealthcheckInterval:    flagOrEnv(*healthcheckIntervalFlag, healthcheckIntervalEnv, "0s"),
+		HealthcheckTimeout:     flagOrEnv(*healthcheckTimeoutFlag, healthcheckTimeoutEnv, "10s"),
+		HealthcheckConcurrency: flagOrEnv(*healthcheckConcurrencyFlag, healthcheckConcurrencyEnv, "4"),
+		TLSCert:                flagOrEnv(*tlsCertFlag, tlsCertEnv, ""),
+		TLSKey:                 flagOrEnv(*tlsKeyFlag, tlsKeyEnv, ""),
+		TLSRedirectAddr:        flagOrEnv(*tlsRedirectAddrFlag, tlsRedirectAddrEnv, ""),
+		ACMEDomains:            flagOrEnv(*acmeDomainsFlag, acmeDomainsEnv, ""),
+		ACMEEmail:              flagOrEnv(*acmeEmailFlag, acmeEmailEnv, ""),
+		ACMEDirectory:          flagOrEnv(*acmeDirectoryFlag, acmeDirectoryEnv, "https://acme-v02.api.letsencrypt.org/directory"),
+		ACMEDirectoryCA:        flagOrEnv(*acmeDirectoryCAFlag, acmeDirectoryCAEnv, ""),
+		TrustedProxies:         flagOrEnv(*trustedProxiesFlag, trustedProxiesEnv, ""),
+		RedirectRateLimit:      flagOrEnv(*redirectRateLimitFlag, redirectRateLimitEnv, "20/s:40"),
+		MissRateLimit:          flagOrEnv(*missRateLimitFlag, missRateLimitEnv, "off"),
+		LoginRateLimit:         flagOrEnv(*loginRateLimitFlag, loginRateLimitEnv, "off"),
+		PasswordRateLimit:      flagOrEnv(*passwordRateLimitFlag, passwordRateLimitEnv, "20/h:5"),
+		CookieSecret:           flagOrEnv(*cookieSecretFlag, cookieSecretEnv, ""),
+		CookiePlainHTTP:        flagOrEnv(*cookiePlainHTTPFlag, cookiePlainHTTPEnv, "false"),
+		AuthType:               flagOrEnv(*authTypeFlag, authTypeEnv, "none"),
+		BasicAuthUser:          flagOrEnv(*basicAuthUserFlag, basicAuthUserEnv, "admin"),
+		BasicAuthPassword:      flagOrEnv(*basicAuthPasswordFlag, basicAuthPasswordEnv, "$2y$12$K7yP/8CraK8RB0yxvv2H4OI6jrC4ym.Xmzx9KQSvqSw3r.3gvtkRu"),
+		BasicAuthUsersFile:     flagOrEnv(*basicAuthUsersFileFlag, basicAuthUsersFileEnv, ""),
+		OidcIssuer:             flagOrEnv(*oidcIssuerFlag, oidcIssuerEnv, "https://idp.example.com"),
+		OidcClientId:           flagOrEnv(*oidcClientIdFlag, oidcClientIdEnv, "client"),
+		OidcClientSecret:       flagOrEnv(*oidcClientSecretFlag, oidcClientSecretEnv, "secret"),
+		OidcRedirectUri:        flagOrEnv(*oidcRedirectUriFlag, oidcRedirectUriEnv, "https://shortlink.example.com/oauth2/callback"),
+		OidcGroupsClaim:        flagOrEnv(*oidcGroupsClaimFlag, oidcGroupsClaimEnv, "groups"),
+		Admins:                 flagOrEnv(*adminsFlag, adminsEnv, ""),
 	}
 }
 
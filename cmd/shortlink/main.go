@@ -2,19 +2,33 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"github.com/patrick246/shortlink/pkg/certs"
+	"github.com/patrick246/shortlink/pkg/healthcheck"
 	"github.com/patrick246/shortlink/pkg/observability/logging"
 	"github.com/patrick246/shortlink/pkg/persistence"
 	"github.com/patrick246/shortlink/pkg/persistence/badger"
 	"github.com/patrick246/shortlink/pkg/persistence/mongodb"
+	"github.com/patrick246/shortlink/pkg/ratelimit"
 	"github.com/patrick246/shortlink/pkg/server"
 	"github.com/patrick246/shortlink/pkg/server/auth"
+	"github.com/patrick246/shortlink/pkg/validation"
+	"github.com/patrick246/shortlink/pkg/vars"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var log = logging.CreateLogger("main")
 
+var trashPurgeInterval = 10 * time.Minute
+var certificateReloadInterval = 30 * time.Second
+
 func main() {
 	conf := getConfig()
 
@@ -42,11 +56,137 @@ func main() {
 	}
 	defer repo.Close()
 
-	err := repo.Migrate(context.Background())
+	var domains []string
+	for _, domain := range strings.Split(conf.Domains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	var defaultDomain string
+	if len(domains) != 0 {
+		defaultDomain = domains[0]
+	}
+
+	err := repo.Migrate(context.Background(), defaultDomain)
 	if err != nil {
 		log.Fatalw("migration error", "error", err)
 	}
 
+	codeNormalization, err := vars.ParseNormalization(conf.CodeNormalization)
+	if err != nil {
+		log.Fatalw("invalid code normalization", "normalization", conf.CodeNormalization, "error", err)
+	}
+
+	if codeNormalization.Enabled() {
+		err = persistence.NormalizeCodes(context.Background(), repo, codeNormalization.String(), codeNormalization.Normalize)
+		if err != nil {
+			log.Fatalw("code normalization error", "error", err)
+		}
+	}
+
+	err = persistence.WarnUnreachableCodes(context.Background(), repo, server.InvalidCode)
+	if err != nil {
+		log.Errorw("error checking for unreachable codes", "error", err)
+	}
+
+	codeSuggestions, err := strconv.Atoi(conf.CodeSuggestions)
+	if err != nil || codeSuggestions < 0 {
+		log.Fatalw("invalid number of code suggestions", "suggestions", conf.CodeSuggestions)
+	}
+
+	trashRetention, err := time.ParseDuration(conf.TrashRetention)
+	if err != nil {
+		log.Fatalw("invalid trash retention", "retention", conf.TrashRetention, "error", err)
+	}
+
+	redirectStatus, err := strconv.Atoi(conf.RedirectStatus)
+	if err != nil || !server.ValidRedirectStatus(redirectStatus) {
+		log.Fatalw("invalid redirect status", "status", conf.RedirectStatus)
+	}
+
+	allowedHosts, err := validation.ParseHostMatchers(conf.AllowedHosts)
+	if err != nil {
+		log.Fatalw("invalid allowed hosts", "hosts", conf.AllowedHosts, "error", err)
+	}
+
+	deniedHosts, err := validation.ParseHostMatchers(conf.DeniedHosts)
+	if err != nil {
+		log.Fatalw("invalid denied hosts", "hosts", conf.DeniedHosts, "error", err)
+	}
+
+	healthcheckInterval, err := time.ParseDuration(conf.HealthcheckInterval)
+	if err != nil {
+		log.Fatalw("invalid healthcheck interval", "interval", conf.HealthcheckInterval, "error", err)
+	}
+
+	healthcheckTimeout, err := time.ParseDuration(conf.HealthcheckTimeout)
+	if err != nil {
+		log.Fatalw("invalid healthcheck timeout", "timeout", conf.HealthcheckTimeout, "error", err)
+	}
+
+	healthcheckConcurrency, err := strconv.Atoi(conf.HealthcheckConcurrency)
+	if err != nil || healthcheckConcurrency < 1 {
+		log.Fatalw("invalid healthcheck concurrency", "concurrency", conf.HealthcheckConcurrency)
+	}
+
+	trustedProxies, err := server.ParseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		log.Fatalw("invalid trusted proxies", "proxies", conf.TrustedProxies, "error", err)
+	}
+
+	redirectRateLimit, err := ratelimit.ParsePolicy(conf.RedirectRateLimit)
+	if err != nil {
+		log.Fatalw("invalid redirect rate limit", "limit", conf.RedirectRateLimit, "error", err)
+	}
+
+	missRateLimit, err := ratelimit.ParsePolicy(conf.MissRateLimit)
+	if err != nil {
+		log.Fatalw("invalid miss rate limit", "limit", conf.MissRateLimit, "error", err)
+	}
+
+	loginRateLimit, err := ratelimit.ParsePolicy(conf.LoginRateLimit)
+	if err != nil {
+		log.Fatalw("invalid login rate limit", "limit", conf.LoginRateLimit, "error", err)
+	}
+
+	passwordRateLimit, err := ratelimit.ParsePolicy(conf.PasswordRateLimit)
+	if err != nil {
+		log.Fatalw("invalid password rate limit", "limit", conf.PasswordRateLimit, "error", err)
+	}
+
+	// Behind a reverse proxy all clients would share the bucket of the proxy, so one client could block everyone
+	if len(trustedProxies) == 0 && missRateLimit.Rate != 0 {
+		log.Warnw("ratelimit.miss is enabled without proxy.trusted, behind a reverse proxy all clients share one limit and a few unknown codes block everyone")
+	}
+	if len(trustedProxies) == 0 && loginRateLimit.Rate != 0 {
+		log.Warnw("ratelimit.login is enabled without proxy.trusted, behind a reverse proxy all clients share one limit and a few failed logins lock out everyone")
+	}
+
+	cookiePlainHTTP, err := strconv.ParseBool(conf.CookiePlainHTTP)
+	if err != nil {
+		log.Fatalw("invalid cookie plain http setting", "value", conf.CookiePlainHTTP)
+	}
+
+	cookieSecret := []byte(conf.CookieSecret)
+	if len(cookieSecret) == 0 {
+		log.Warnw("no cookie secret configured, generating a random one. Unlocked password protected shortlinks won't survive restarts")
+		cookieSecret = make([]byte, 32)
+		_, err = rand.Read(cookieSecret)
+		if err != nil {
+			log.Fatalw("error generating cookie secret", "error", err)
+		}
+	}
+
+	var admins []string
+	for _, admin := range strings.Split(conf.Admins, ",") {
+		admin = strings.TrimSpace(admin)
+		if admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+
 	var authMiddleware server.MiddlewareFactory
 	log.Infow("setting up authentication", "type", conf.AuthType)
 
@@ -54,7 +194,17 @@ func main() {
 	case "none":
 		authMiddleware = auth.Noop()
 	case "basic":
-		authMiddleware = auth.BasicAuth(conf.BasicAuthUser, conf.BasicAuthPassword, "/admin/shortlinks")
+		users := map[string]string{conf.BasicAuthUser: conf.BasicAuthPassword}
+		if conf.BasicAuthUsersFile != "" {
+			fileUsers, err := auth.ReadUsersFile(conf.BasicAuthUsersFile)
+			if err != nil {
+				log.Fatalw("error reading basic auth users", "path", conf.BasicAuthUsersFile, "error", err)
+			}
+			for user, hash := range fileUsers {
+				users[user] = hash
+			}
+		}
+		authMiddleware = auth.BasicAuth(users, loginRateLimit, server.SecuredPrefixes...)
 	case "oidc":
 		var err error
 		authMiddleware, err = auth.OpenIDConnect(auth.OidcConfig{
@@ -62,7 +212,8 @@ func main() {
 			ClientId:     conf.OidcClientId,
 			ClientSecret: conf.OidcClientSecret,
 			RedirectUri:  conf.OidcRedirectUri,
-		}, "/admin/shortlinks")
+			GroupsClaim:  conf.OidcGroupsClaim,
+		}, server.SecuredPrefixes...)
 		if err != nil {
 			log.Fatalw("oidc error", "issuer", conf.OidcIssuer, "clientId", conf.OidcClientId, "redirectUri", conf.OidcRedirectUri, "error", err)
 		}
@@ -77,7 +228,82 @@ func main() {
 		cancel()
 	}()
 
-	shortlinkServer := server.New(conf.ListenAddr, repo, authMiddleware)
+	go persistence.RunTrashPurger(runCtx, repo, trashRetention, trashPurgeInterval)
+
+	if healthcheckInterval > 0 {
+		checker := healthcheck.New(repo, healthcheckInterval, healthcheckTimeout, healthcheckConcurrency)
+		go checker.Run(runCtx)
+	}
+
+	var tlsConfig *tls.Config
+	var httpChallengeHandler func(http.Handler) http.Handler
+	if conf.ACMEDomains != "" && (conf.TLSCert != "" || conf.TLSKey != "") {
+		log.Fatalw("acme and tls certificate files can't be used together")
+	}
+
+	if conf.ACMEDomains != "" {
+		var acmeDomains []string
+		for _, domain := range strings.Split(conf.ACMEDomains, ",") {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain != "" {
+				acmeDomains = append(acmeDomains, domain)
+			}
+		}
+		if len(acmeDomains) == 0 {
+			log.Fatalw("no acme domains given", "domains", conf.ACMEDomains)
+		}
+		// Without the plain HTTP listener HTTP-01 challenges would fail, which is only noticed when a certificate is due
+		if conf.TLSRedirectAddr == "" {
+			log.Fatalw("acme requires tls.redirect-addr to answer http-01 challenges, e.g. :80")
+		}
+
+		manager, err := certs.NewACMEManager(repo, certs.ACMEConfig{
+			Domains:      acmeDomains,
+			Email:        conf.ACMEEmail,
+			DirectoryURL: conf.ACMEDirectory,
+			DirectoryCA:  conf.ACMEDirectoryCA,
+		})
+		if err != nil {
+			log.Fatalw("acme error", "directory", conf.ACMEDirectory, "error", err)
+		}
+
+		tlsConfig = manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		httpChallengeHandler = manager.HTTPHandler
+	} else if conf.TLSCert != "" || conf.TLSKey != "" {
+		reloader, err := certs.NewFileReloader(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			log.Fatalw("invalid tls certificate", "cert", conf.TLSCert, "key", conf.TLSKey, "error", err)
+		}
+		go reloader.Run(runCtx, certificateReloadInterval)
+
+		tlsConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	shortlinkServer := server.New(conf.ListenAddr, repo, authMiddleware, server.Options{
+		DefaultRedirectStatus: redirectStatus,
+		URLPolicy: validation.Policy{
+			AllowedSchemes: strings.Split(conf.AllowedSchemes, ","),
+			AllowedHosts:   allowedHosts,
+			DeniedHosts:    deniedHosts,
+		},
+		CookieSecret:         cookieSecret,
+		RedirectRateLimit:    redirectRateLimit,
+		MissRateLimit:        missRateLimit,
+		PasswordRateLimit:    passwordRateLimit,
+		TrustedProxies:       trustedProxies,
+		PlainHTTPCookies:     cookiePlainHTTP,
+		TLSConfig:            tlsConfig,
+		HTTPRedirectAddr:     conf.TLSRedirectAddr,
+		HTTPChallengeHandler: httpChallengeHandler,
+		Domains:              domains,
+		CodeNormalization:    codeNormalization,
+		CodeSuggestions:      codeSuggestions,
+		Admins:               admins,
+	})
 	err = shortlinkServer.ListenAndServe(runCtx)
 	if err != nil {
 		log.Fatalw("server error", "addr", conf.ListenAddr, "error", err)
@@ -0,0 +1,81 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+)
+
+type ACMEConfig struct {
+	// Domains are the only host names certificates are requested for
+	Domains []string
+	Email   string
+	// DirectoryURL of the ACME server, Let's Encrypt is used if empty
+	DirectoryURL string
+	// DirectoryCA is a PEM file trusted for connections to the ACME server, e.g. the CA of a local Pebble instance
+	DirectoryCA string
+}
+
+// NewACMEManager requests and renews certificates on demand. Accounts, certificates and challenge tokens are stored in
+// the repository, so all replicas share them and can answer challenges started by another replica.
+func NewACMEManager(repo persistence.Repository, config ACMEConfig) (*autocert.Manager, error) {
+	client := &acme.Client{
+		DirectoryURL: config.DirectoryURL,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	if config.DirectoryCA != "" {
+		caPem, err := ioutil.ReadFile(config.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("no certificates found in directory CA file")
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      repositoryCache{repo: repo},
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Client:     client,
+		Email:      config.Email,
+	}, nil
+}
+
+// repositoryCache implements autocert.Cache on top of the persistence backend
+type repositoryCache struct {
+	repo persistence.Repository
+}
+
+func (c repositoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.repo.GetCertificateData(ctx, key)
+	if err == persistence.ErrNotFound {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (c repositoryCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.repo.SetCertificateData(ctx, key, data)
+}
+
+func (c repositoryCache) Delete(ctx context.Context, key string) error {
+	return c.repo.DeleteCertificateData(ctx, key)
+}
@@ -0,0 +1,468 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrick246/shortlink/pkg/persistence/badger"
+)
+
+// fakeACME is a minimal ACME server in the spirit of Pebble. It offers HTTP-01 challenges only and validates them by
+// requesting the token from challengeAddr, where the plain HTTP listener of the shortlink server would be reachable.
+// Signatures of the requests aren't verified.
+type fakeACME struct {
+	*httptest.Server
+	challengeAddr string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	nonce      int
+	thumbprint string
+	orders     []*fakeOrder
+}
+
+type fakeOrder struct {
+	domain      string
+	token       string
+	status      string
+	authzStatus string
+	certificate []byte
+}
+
+type jwsRequest struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeACME{caKey: caKey, caCert: caCert}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// writeCA writes the certificate of the TLS listener, like the CA file Pebble is started with
+func (f *fakeACME) writeCA(t *testing.T) string {
+	file := filepath.Join(t.TempDir(), "acme-ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw})
+	err := ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (f *fakeACME) orderCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.orders)
+}
+
+func (f *fakeACME) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", f.nonce))
+
+	if r.URL.Path == "/directory" {
+		f.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/order",
+			"revokeCert": f.URL + "/revoke",
+			"keyChange":  f.URL + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var request jwsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(request.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var id int
+	switch {
+	case r.URL.Path == "/account":
+		f.newAccount(w, request)
+	case r.URL.Path == "/order":
+		f.newOrder(w, payload)
+	case scan(r.URL.Path, "/order/%d", &id) && f.known(id):
+		f.writeOrder(w, http.StatusOK, id)
+	case scan(r.URL.Path, "/authz/%d", &id) && f.known(id):
+		f.writeAuthz(w, id)
+	case scan(r.URL.Path, "/challenge/%d", &id) && f.known(id):
+		f.validate(w, id)
+	case scan(r.URL.Path, "/finalize/%d", &id) && f.known(id):
+		f.finalize(w, id, payload)
+	case scan(r.URL.Path, "/cert/%d", &id) && f.known(id):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(f.orders[id].certificate)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func scan(path, format string, id *int) bool {
+	_, err := fmt.Sscanf(path, format, id)
+	return err == nil
+}
+
+func (f *fakeACME) known(id int) bool {
+	return id >= 0 && id < len(f.orders)
+}
+
+func (f *fakeACME) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newAccount remembers the thumbprint of the account key, the key authorization of the challenges contains it
+func (f *fakeACME) newAccount(w http.ResponseWriter, request jwsRequest) {
+	protected, err := base64.RawURLEncoding.DecodeString(request.Protected)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var header struct {
+		JWK struct {
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"jwk"`
+	}
+	err = json.Unmarshal(protected, &header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jwk := fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, header.JWK.Crv, header.JWK.X, header.JWK.Y)
+	sum := sha256.Sum256([]byte(jwk))
+	f.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+
+	w.Header().Set("Location", f.URL+"/account/1")
+	f.writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+}
+
+func (f *fakeACME) newOrder(w http.ResponseWriter, payload []byte) {
+	var request struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil || len(request.Identifiers) != 1 {
+		http.Error(w, "expected one identifier", http.StatusBadRequest)
+		return
+	}
+
+	f.orders = append(f.orders, &fakeOrder{
+		domain:      request.Identifiers[0].Value,
+		token:       fmt.Sprintf("token-%d", len(f.orders)),
+		status:      "pending",
+		authzStatus: "pending",
+	})
+	f.writeOrder(w, http.StatusCreated, len(f.orders)-1)
+}
+
+func (f *fakeACME) writeOrder(w http.ResponseWriter, status, id int) {
+	order := f.orders[id]
+	response := map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", f.URL, id)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", f.URL, id),
+	}
+	if order.certificate != nil {
+		response["certificate"] = fmt.Sprintf("%s/cert/%d", f.URL, id)
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", f.URL, id))
+	f.writeJSON(w, status, response)
+}
+
+func (f *fakeACME) writeAuthz(w http.ResponseWriter, id int) {
+	order := f.orders[id]
+	f.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     order.authzStatus,
+		"identifier": map[string]string{"type": "dns", "value": order.domain},
+		"challenges": []map[string]string{{
+			"type":   "http-01",
+			"url":    fmt.Sprintf("%s/challenge/%d", f.URL, id),
+			"token":  order.token,
+			"status": order.authzStatus,
+		}},
+	})
+}
+
+// validate requests the token like a CA would from http://<domain>/.well-known/acme-challenge/<token>
+func (f *fakeACME) validate(w http.ResponseWriter, id int) {
+	order := f.orders[id]
+	order.authzStatus = "invalid"
+	order.status = "invalid"
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+f.challengeAddr+"/.well-known/acme-challenge/"+order.token, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Host = order.domain
+	res, err := http.DefaultClient.Do(req)
+	if err == nil {
+		body, _ := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode == http.StatusOK && string(body) == order.token+"."+f.thumbprint {
+			order.authzStatus = "valid"
+			order.status = "ready"
+		}
+	}
+
+	f.writeJSON(w, http.StatusOK, map[string]string{
+		"type":   "http-01",
+		"url":    fmt.Sprintf("%s/challenge/%d", f.URL, id),
+		"token":  order.token,
+		"status": order.authzStatus,
+	})
+}
+
+func (f *fakeACME) finalize(w http.ResponseWriter, id int, payload []byte) {
+	order := f.orders[id]
+	if order.status != "ready" {
+		http.Error(w, "order not ready", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		CSR string `json:"csr"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(request.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Like Let's Encrypt, the common name is accepted as domain if there are no alternative names
+	names := csr.DNSNames
+	if len(names) == 0 {
+		names = []string{csr.Subject.CommonName}
+	}
+	if len(names) != 1 || names[0] != order.domain {
+		http.Error(w, "csr doesn't match the order", http.StatusBadRequest)
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id) + 2),
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		// autocert renews certificates expiring within 30 days right away
+		NotAfter:    time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	order.certificate = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+	order.status = "valid"
+	f.writeOrder(w, http.StatusOK, id)
+}
+
+// serveTLS accepts TLS connections with the config of the manager, like the HTTPS listener of the shortlink server
+func serveTLS(t *testing.T, config *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// handshake connects to the listener and returns the certificate chain presented for the domain
+func handshake(t *testing.T, addr, domain string, roots *x509.CertPool) []*x509.Certificate {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName: domain,
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates
+}
+
+func TestACMEManagerObtainsCertificateWithHTTPChallenge(t *testing.T) {
+	const domain = "go.shortlink.test"
+	acmeServer := newFakeACME(t)
+
+	repo, err := badger.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	config := ACMEConfig{
+		Domains:      []string{domain},
+		Email:        "admin@shortlink.test",
+		DirectoryURL: acmeServer.URL + "/directory",
+		DirectoryCA:  acmeServer.writeCA(t),
+	}
+	manager, err := NewACMEManager(repo, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plain HTTP listener answers the challenges, other requests get the fallback
+	challengeServer := httptest.NewServer(manager.HTTPHandler(http.NotFoundHandler()))
+	defer challengeServer.Close()
+	acmeServer.challengeAddr = strings.TrimPrefix(challengeServer.URL, "http://")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(acmeServer.caCert)
+
+	chain := handshake(t, serveTLS(t, manager.TLSConfig()), domain, roots)
+	if chain[0].Subject.CommonName != domain {
+		t.Errorf("expected a certificate for %s, got %s", domain, chain[0].Subject.CommonName)
+	}
+	if count := acmeServer.orderCount(); count != 1 {
+		t.Errorf("expected a single order, got %d", count)
+	}
+
+	// Another replica sharing the storage uses the stored certificate without a new order
+	replica, err := NewACMEManager(repo, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain = handshake(t, serveTLS(t, replica.TLSConfig()), domain, roots)
+	if chain[0].Subject.CommonName != domain {
+		t.Errorf("expected a certificate for %s from the replica, got %s", domain, chain[0].Subject.CommonName)
+	}
+	if count := acmeServer.orderCount(); count != 1 {
+		t.Errorf("expected the replica to reuse the certificate, got %d orders", count)
+	}
+}
+
+func TestACMEManagerRejectsUnknownDomains(t *testing.T) {
+	acmeServer := newFakeACME(t)
+
+	repo, err := badger.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	manager, err := NewACMEManager(repo, ACMEConfig{
+		Domains:      []string{"go.shortlink.test"},
+		DirectoryURL: acmeServer.URL + "/directory",
+		DirectoryCA:  acmeServer.writeCA(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.shortlink.test"})
+	if err == nil {
+		t.Error("expected an error for a domain that isn't configured")
+	}
+	if count := acmeServer.orderCount(); count != 0 {
+		t.Errorf("expected no orders, got %d", count)
+	}
+}
+
+func TestNewACMEManagerRequiresDirectoryCACertificates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "empty.pem")
+	err := ioutil.WriteFile(file, []byte("no certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewACMEManager(nil, ACMEConfig{Domains: []string{"go.shortlink.test"}, DirectoryCA: file})
+	if err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+}
@@ -0,0 +1,113 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/patrick246/shortlink/pkg/observability/logging"
+	"os"
+	"sync"
+	"time"
+)
+
+var log = logging.CreateLogger("certs")
+
+// FileReloader serves a certificate from PEM files and reloads it when the files change, e.g. after a renewal
+type FileReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func NewFileReloader(certFile, keyFile string) (*FileReloader, error) {
+	reloader := &FileReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	err = reloader.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Run checks the files for changes every interval. It blocks until ctx is cancelled.
+func (f *FileReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := f.filesModTime()
+		if err != nil {
+			log.Errorw("error checking certificate files", "cert", f.certFile, "key", f.keyFile, "error", err)
+			continue
+		}
+
+		f.mu.RLock()
+		changed := !modTime.Equal(f.modTime)
+		f.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// The files might be replaced one after the other, a failed load is retried on the next tick
+		err = f.load(modTime)
+		if err != nil {
+			log.Errorw("error reloading certificate, keeping the previous one", "cert", f.certFile, "key", f.keyFile, "error", err)
+			continue
+		}
+		log.Infow("reloaded certificate", "cert", f.certFile)
+	}
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (f *FileReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.certificate, nil
+}
+
+func (f *FileReloader) load(modTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.certificate = &certificate
+	f.modTime = modTime
+	return nil
+}
+
+// filesModTime is the latest modification of both files
+func (f *FileReloader) filesModTime() (time.Time, error) {
+	certInfo, err := os.Stat(f.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(f.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
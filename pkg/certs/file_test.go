@@ -0,0 +1,146 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate generates a self-signed certificate for the common name and writes it with its key to the files.
+// The files are written next to the target and renamed, like tools renewing certificates do.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modTime)
+}
+
+// writeFile sets the modification time explicitly, file systems with a coarse resolution wouldn't notice the change
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	tmp := file + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(tmp, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmp, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, certificate *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+// waitForCertificate polls the reloader until it serves the certificate for the common name
+func waitForCertificate(t *testing.T, reloader *FileReloader, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		certificate, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := commonName(t, certificate)
+		if name == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the certificate for %s, still serving %s", expected, name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileReloaderReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "old.example.com", start)
+
+	reloader, err := NewFileReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCertificate(t, reloader, "old.example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Run(ctx, 10*time.Millisecond)
+
+	writeCertificate(t, certFile, keyFile, "new.example.com", start.Add(time.Second))
+	waitForCertificate(t, reloader, "new.example.com")
+}
+
+func TestFileReloaderKeepsCertificateOnInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	start := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "old.example.com", start)
+
+	reloader, err := NewFileReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Run(ctx, 10*time.Millisecond)
+
+	// Only the key has been replaced so far, it doesn't match the certificate
+	otherDir := t.TempDir()
+	writeCertificate(t, filepath.Join(otherDir, "tls.crt"), filepath.Join(otherDir, "tls.key"), "other.example.com", start)
+	key, err := ioutil.ReadFile(filepath.Join(otherDir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, keyFile, key, start.Add(time.Second))
+
+	time.Sleep(100 * time.Millisecond)
+	waitForCertificate(t, reloader, "old.example.com")
+
+	// The reload is retried once the certificate matches the key again
+	writeCertificate(t, certFile, keyFile, "new.example.com", start.Add(2*time.Second))
+	waitForCertificate(t, reloader, "new.example.com")
+}
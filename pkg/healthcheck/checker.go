@@ -0,0 +1,287 @@
+package healthcheck
+
+import (
+	"context"
+	"github.com/patrick246/shortlink/pkg/observability/logging"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var log = logging.CreateLogger("healthcheck")
+
+// maxBackoffExponent caps the backoff of broken destinations at 2^6 check intervals
+const maxBackoffExponent = 6
+
+var destinationUpGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "shortlink_destination_up",
+	Help: "Whether the destination of a shortcode was reachable on the last check",
+}, []string{"domain", "shortcode"})
+
+var destinationLatencyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "shortlink_destination_latency_seconds",
+	Help: "Response time of the destination of a shortcode on the last check",
+}, []string{"domain", "shortcode"})
+
+var brokenDestinationsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "shortlink_broken_destination_count",
+	Help: "Number of shortlinks whose destination failed the last check",
+})
+
+func init() {
+	prometheus.MustRegister(destinationUpGauge, destinationLatencyGauge, brokenDestinationsGauge)
+}
+
+// Checker periodically requests the destinations of all shortlinks and records whether they are reachable
+type Checker struct {
+	repo        persistence.Repository
+	client      *http.Client
+	interval    time.Duration
+	concurrency int
+
+	// recorded holds the keys of the shortlinks with metrics, so the metrics can be removed with the shortlink
+	recordedLock sync.Mutex
+	recorded     map[string]bool
+}
+
+func New(repo persistence.Repository, interval, timeout time.Duration, concurrency int) *Checker {
+	return &Checker{
+		repo: repo,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		interval:    interval,
+		concurrency: concurrency,
+		recorded:    make(map[string]bool),
+	}
+}
+
+// Run checks all destinations every interval. It blocks until ctx is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		err := c.CheckAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorw("error checking destinations", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every active shortlink that is due according to its backoff. The metrics of shortlinks that have been
+// trashed, renamed or aren't active anymore are removed.
+func (c *Checker) CheckAll(ctx context.Context) error {
+	shortlinks, err := persistence.AllEntries(ctx, c.repo)
+	if err != nil {
+		return err
+	}
+
+	var broken int64
+	now := time.Now()
+	work := make(chan persistence.Shortlink)
+	var wg sync.WaitGroup
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shortlink := range work {
+				health, destination := c.CheckShortlink(ctx, shortlink, now)
+				// The shortlink has been changed or removed during the check, the result belongs to old destinations
+				err := c.repo.UpdateHealth(ctx, shortlink, health)
+				if err == persistence.ErrConflict || err == persistence.ErrNotFound {
+					continue
+				}
+				if err != nil {
+					log.Errorw("error saving destination health", "domain", shortlink.Domain, "code", shortlink.Code, "error", err)
+				}
+
+				c.record(shortlink, destination, health)
+				if health.Broken() {
+					atomic.AddInt64(&broken, 1)
+				}
+			}
+		}()
+	}
+
+	checked := make(map[string]bool)
+	for _, shortlink := range shortlinks {
+		// The destination of templates depends on the request, there is no single URL to check
+		if !shortlink.IsActive(now) || shortlink.Template {
+			continue
+		}
+		checked[persistence.Key(shortlink.Domain, shortlink.Code)] = true
+		if !c.due(shortlink.Health, now) {
+			// The metrics are set from the last check, e.g. after a restart or if another replica checked it
+			c.setMetrics(shortlink, shortlink.Health)
+			if shortlink.Health.Broken() {
+				atomic.AddInt64(&broken, 1)
+			}
+			continue
+		}
+
+		select {
+		case work <- shortlink:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	brokenDestinationsGauge.Set(float64(broken))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	c.removeMetrics(checked)
+	return nil
+}
+
+// CheckShortlink checks all destinations requests can currently be sent to. The health is the one of the first broken
+// destination, or of the slowest one if all are reachable. The destination the health belongs to is returned as well.
+func (c *Checker) CheckShortlink(ctx context.Context, shortlink persistence.Shortlink, now time.Time) (persistence.Health, string) {
+	start := time.Now().UTC()
+	var health persistence.Health
+	var healthDestination string
+	for _, destination := range destinations(shortlink, now) {
+		result := c.Check(ctx, destination, shortlink.Health)
+		if healthDestination == "" || worse(result, health) {
+			health, healthDestination = result, destination
+		}
+	}
+	health.CheckedAt = start
+	return health, healthDestination
+}
+
+func worse(a, b persistence.Health) bool {
+	if a.Broken() != b.Broken() {
+		return a.Broken()
+	}
+	return !a.Broken() && a.Latency > b.Latency
+}
+
+// destinations returns the distinct URLs of the rules and either the variants or the scheduled destination, the
+// variants replace the schedule
+func destinations(shortlink persistence.Shortlink, now time.Time) []string {
+	var urls []string
+	for _, rule := range shortlink.Rules {
+		urls = append(urls, rule.URL)
+	}
+	if len(shortlink.Variants) != 0 {
+		for _, variant := range shortlink.Variants {
+			urls = append(urls, variant.URL)
+		}
+	} else {
+		urls = append(urls, shortlink.Destination(now))
+	}
+
+	seen := make(map[string]bool)
+	distinct := urls[:0]
+	for _, url := range urls {
+		if !seen[url] {
+			seen[url] = true
+			distinct = append(distinct, url)
+		}
+	}
+	return distinct
+}
+
+// Check requests the destination with HEAD, falling back to GET for servers not supporting HEAD
+func (c *Checker) Check(ctx context.Context, destination string, previous persistence.Health) persistence.Health {
+	start := time.Now()
+	status, err := c.request(ctx, http.MethodHead, destination)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		start = time.Now()
+		status, err = c.request(ctx, http.MethodGet, destination)
+	}
+
+	health := persistence.Health{
+		CheckedAt:  start.UTC(),
+		StatusCode: status,
+		Latency:    time.Since(start),
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	if health.Broken() {
+		health.ConsecutiveFailures = previous.ConsecutiveFailures + 1
+	}
+	return health
+}
+
+func (c *Checker) request(ctx context.Context, method, destination string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, destination, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "shortlink-healthcheck")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// due backs off exponentially for broken destinations, so dead hosts aren't hammered every interval
+func (c *Checker) due(health persistence.Health, now time.Time) bool {
+	if health.CheckedAt.IsZero() {
+		return true
+	}
+
+	exponent := health.ConsecutiveFailures - 1
+	if exponent < 0 {
+		exponent = 0
+	}
+	if exponent > maxBackoffExponent {
+		exponent = maxBackoffExponent
+	}
+	next := health.CheckedAt.Add(c.interval * time.Duration(1<<exponent))
+	// Allow for the time the previous run took, otherwise healthy links would only be checked every other run
+	return !next.After(now.Add(c.interval / 10))
+}
+
+func (c *Checker) record(shortlink persistence.Shortlink, destination string, health persistence.Health) {
+	if health.Broken() {
+		log.Warnw("broken destination", "domain", shortlink.Domain, "code", shortlink.Code, "dest", destination, "status", health.StatusCode, "error", health.Error, "failures", health.ConsecutiveFailures)
+	}
+	c.setMetrics(shortlink, health)
+}
+
+func (c *Checker) setMetrics(shortlink persistence.Shortlink, health persistence.Health) {
+	up := 1.0
+	if health.Broken() {
+		up = 0
+	}
+	destinationUpGauge.WithLabelValues(shortlink.Domain, shortlink.Code).Set(up)
+	destinationLatencyGauge.WithLabelValues(shortlink.Domain, shortlink.Code).Set(health.Latency.Seconds())
+
+	c.recordedLock.Lock()
+	c.recorded[persistence.Key(shortlink.Domain, shortlink.Code)] = true
+	c.recordedLock.Unlock()
+}
+
+// removeMetrics deletes the metrics of the shortlinks that haven't been part of the last check
+func (c *Checker) removeMetrics(checked map[string]bool) {
+	c.recordedLock.Lock()
+	defer c.recordedLock.Unlock()
+
+	for key := range c.recorded {
+		if checked[key] {
+			continue
+		}
+		domain, code := persistence.SplitKey(key)
+		destinationUpGauge.DeleteLabelValues(domain, code)
+		destinationLatencyGauge.DeleteLabelValues(domain, code)
+		delete(c.recorded, key)
+	}
+}
@@ -0,0 +1,258 @@
+package healthcheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/patrick246/shortlink/pkg/persistence/badger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// destinationServer answers HEAD requests with 200, paths listed in status get their status code instead
+type destinationServer struct {
+	*httptest.Server
+	status map[string]int
+
+	lock     sync.Mutex
+	requests []string
+}
+
+func newDestinationServer(t *testing.T, status map[string]int) *destinationServer {
+	d := &destinationServer{status: status}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.lock.Lock()
+		d.requests = append(d.requests, r.Method+" "+r.URL.Path)
+		d.lock.Unlock()
+
+		if code, ok := d.status[r.URL.Path]; ok {
+			w.WriteHeader(code)
+		}
+	}))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *destinationServer) requested() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	requests := append([]string(nil), d.requests...)
+	sort.Strings(requests)
+	return requests
+}
+
+func newRepository(t *testing.T) persistence.Repository {
+	repo, err := badger.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+	return repo
+}
+
+func setEntries(t *testing.T, repo persistence.Repository, shortlinks ...persistence.Shortlink) {
+	for _, shortlink := range shortlinks {
+		err := repo.SetEntry(context.Background(), shortlink)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// recordedCodes returns the codes of the domain with a destination up metric, sorted
+func recordedCodes(t *testing.T, domain string) []string {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(destinationUpGauge)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var codes []string
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["domain"] == domain {
+				codes = append(codes, labels["shortcode"])
+			}
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCheckFallsBackToGet(t *testing.T) {
+	server := newDestinationServer(t, nil)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	checker := New(newRepository(t), time.Minute, time.Second, 1)
+	health := checker.Check(context.Background(), server.URL, persistence.Health{})
+	if health.Broken() || health.StatusCode != http.StatusOK {
+		t.Errorf("expected a healthy destination, got %+v", health)
+	}
+}
+
+func TestCheckCountsConsecutiveFailures(t *testing.T) {
+	server := newDestinationServer(t, map[string]int{"/gone": http.StatusNotFound})
+
+	checker := New(newRepository(t), time.Minute, time.Second, 1)
+	health := checker.Check(context.Background(), server.URL+"/gone", persistence.Health{ConsecutiveFailures: 2})
+	if !health.Broken() || health.StatusCode != http.StatusNotFound || health.ConsecutiveFailures != 3 {
+		t.Errorf("expected the third failure with status 404, got %+v", health)
+	}
+
+	health = checker.Check(context.Background(), "http://127.0.0.1:1/", persistence.Health{})
+	if !health.Broken() || health.Error == "" {
+		t.Errorf("expected an error for an unreachable destination, got %+v", health)
+	}
+}
+
+func TestCheckAllChecksAllDestinations(t *testing.T) {
+	server := newDestinationServer(t, map[string]int{"/variant-b": http.StatusInternalServerError})
+	repo := newRepository(t)
+	now := time.Now()
+	setEntries(t, repo, persistence.Shortlink{
+		Code: "scheduled",
+		URL:  server.URL + "/old",
+		Schedule: []persistence.ScheduledDestination{
+			{From: now.Add(-time.Hour), URL: server.URL + "/current"},
+			{From: now.Add(time.Hour), URL: server.URL + "/future"},
+		},
+		Rules: []persistence.Rule{
+			{Device: "ios", URL: server.URL + "/ios"},
+			{Language: "de", URL: server.URL + "/ios"},
+		},
+	}, persistence.Shortlink{
+		Code: "split",
+		URL:  server.URL + "/replaced",
+		Variants: []persistence.Variant{
+			{Name: "a", URL: server.URL + "/variant-a", Weight: 1},
+			{Name: "b", URL: server.URL + "/variant-b", Weight: 1},
+		},
+	}, persistence.Shortlink{
+		Code:     "template",
+		URL:      server.URL + "/{1}",
+		Template: true,
+	})
+
+	checker := New(repo, time.Minute, time.Second, 2)
+	err := checker.CheckAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"HEAD /current", "HEAD /ios", "HEAD /variant-a", "HEAD /variant-b"}
+	if requested := server.requested(); !equal(requested, expected) {
+		t.Errorf("expected requests %v, got %v", expected, requested)
+	}
+
+	scheduled, err := repo.GetEntryForCode(context.Background(), "", "scheduled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled.Health.Broken() || scheduled.Health.CheckedAt.IsZero() {
+		t.Errorf("expected a healthy shortlink, got %+v", scheduled.Health)
+	}
+
+	split, err := repo.GetEntryForCode(context.Background(), "", "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !split.Health.Broken() || split.Health.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the broken variant to break the shortlink, got %+v", split.Health)
+	}
+	if up := testutil.ToFloat64(destinationUpGauge.WithLabelValues("", "split")); up != 0 {
+		t.Errorf("expected the split to be down, got %v", up)
+	}
+}
+
+func TestCheckAllRemovesMetricsOfRemovedShortlinks(t *testing.T) {
+	server := newDestinationServer(t, nil)
+	repo := newRepository(t)
+	// The metrics are global, the domain keeps them apart from the ones of other tests
+	domain := server.Listener.Addr().String()
+	setEntries(t, repo,
+		persistence.Shortlink{Domain: domain, Code: "trashed", URL: server.URL},
+		persistence.Shortlink{Domain: domain, Code: "old-name", URL: server.URL},
+		persistence.Shortlink{Domain: domain, Code: "kept", URL: server.URL},
+	)
+
+	checker := New(repo, time.Minute, time.Second, 1)
+	err := checker.CheckAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes := recordedCodes(t, domain); !equal(codes, []string{"kept", "old-name", "trashed"}) {
+		t.Fatalf("expected metrics for all shortlinks, got %v", codes)
+	}
+
+	err = repo.TrashCode(context.Background(), domain, "trashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.RenameCode(context.Background(), domain, "old-name", domain, "new-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checker.CheckAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if codes := recordedCodes(t, domain); !equal(codes, []string{"kept", "new-name"}) {
+		t.Errorf("expected metrics for the kept and the renamed shortlink, got %v", codes)
+	}
+}
+
+func TestCheckAllDiscardsResultsOfChangedShortlinks(t *testing.T) {
+	repo := newRepository(t)
+	server := newDestinationServer(t, nil)
+	// The shortlink is edited while its old destination is being checked
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setEntries(t, repo, persistence.Shortlink{Code: "edited", URL: server.URL + "/new"})
+		w.WriteHeader(http.StatusNotFound)
+	})
+	setEntries(t, repo, persistence.Shortlink{Code: "edited", URL: server.URL + "/old"})
+
+	checker := New(repo, time.Minute, time.Second, 1)
+	err := checker.CheckAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited, err := repo.GetEntryForCode(context.Background(), "", "edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.URL != server.URL+"/new" || !edited.Health.CheckedAt.IsZero() {
+		t.Errorf("expected the new destination without the health of the old one, got %s with %+v", edited.URL, edited.Health)
+	}
+}
@@ -0,0 +1,320 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"strings"
+	"time"
+)
+
+type Shortlink struct {
+	URL            string                 `json:"url"`
+	TTL            time.Time              `json:"ttl"`
+	ActiveFrom     time.Time              `json:"activeFrom"`
+	Schedule       []ScheduledDestination `json:"schedule,omitempty"`
+	Rules          []Rule                 `json:"rules,omitempty"`
+	Variants       []Variant              `json:"variants,omitempty"`
+	StickyVariants bool                   `json:"stickyVariants,omitempty"`
+	Campaign       *Campaign              `json:"campaign,omitempty"`
+	RedirectStatus int                    `json:"redirectStatus,omitempty"`
+	Passthrough    bool                   `json:"passthrough,omitempty"`
+	Template       bool                   `json:"template,omitempty"`
+	Title          string                 `json:"title,omitempty"`
+	Interstitial   bool                   `json:"interstitial,omitempty"`
+	Warning        string                 `json:"warning,omitempty"`
+	PasswordHash   string                 `json:"passwordHash,omitempty"`
+	Internal       bool                   `json:"internal,omitempty"`
+	Health         *Health                `json:"health,omitempty"`
+}
+
+type Health struct {
+	CheckedAt           time.Time     `json:"checkedAt"`
+	StatusCode          int           `json:"statusCode"`
+	Latency             time.Duration `json:"latency"`
+	Error               string        `json:"error,omitempty"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+}
+
+type ScheduledDestination struct {
+	From time.Time `json:"from"`
+	URL  string    `json:"url"`
+}
+
+type Rule struct {
+	Device   string `json:"device,omitempty"`
+	Language string `json:"language,omitempty"`
+	Query    string `json:"query,omitempty"`
+	URL      string `json:"url"`
+}
+
+type Campaign struct {
+	Source  string `json:"source,omitempty"`
+	Medium  string `json:"medium,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Term    string `json:"term,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type Variant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+type TrashedShortlink struct {
+	Shortlink
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+type Alias struct {
+	Target string `json:"target"`
+}
+
+type Namespace struct {
+	Members []string `json:"members"`
+}
+
+type Revision struct {
+	Shortlink
+	Editor    string    `json:"editor"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func fromGeneric(shortlink persistence.Shortlink) Shortlink {
+	var schedule []ScheduledDestination
+	for _, s := range shortlink.Schedule {
+		schedule = append(schedule, ScheduledDestination{
+			From: s.From,
+			URL:  s.URL,
+		})
+	}
+
+	var rules []Rule
+	for _, r := range shortlink.Rules {
+		rules = append(rules, Rule(r))
+	}
+
+	var variants []Variant
+	for _, v := range shortlink.Variants {
+		variants = append(variants, Variant(v))
+	}
+
+	return Shortlink{
+		URL:            shortlink.URL,
+		TTL:            shortlink.TTL,
+		ActiveFrom:     shortlink.ActiveFrom,
+		Schedule:       schedule,
+		Rules:          rules,
+		Variants:       variants,
+		StickyVariants: shortlink.StickyVariants,
+		Campaign:       campaignFromGeneric(shortlink.Campaign),
+		RedirectStatus: shortlink.RedirectStatus,
+		Passthrough:    shortlink.Passthrough,
+		Template:       shortlink.Template,
+		Title:          shortlink.Title,
+		Interstitial:   shortlink.Interstitial,
+		Warning:        shortlink.Warning,
+		PasswordHash:   shortlink.PasswordHash,
+		Internal:       shortlink.Internal,
+		Health:         healthFromGeneric(shortlink.Health),
+	}
+}
+
+// toGeneric takes the domain and code from the key, they aren't part of the stored value
+func toGeneric(key string, shortlink Shortlink) persistence.Shortlink {
+	domain, code := persistence.SplitKey(key)
+
+	var schedule []persistence.ScheduledDestination
+	for _, s := range shortlink.Schedule {
+		schedule = append(schedule, persistence.ScheduledDestination{
+			From: s.From,
+			URL:  s.URL,
+		})
+	}
+
+	var rules []persistence.Rule
+	for _, r := range shortlink.Rules {
+		rules = append(rules, persistence.Rule(r))
+	}
+
+	var variants []persistence.Variant
+	for _, v := range shortlink.Variants {
+		variants = append(variants, persistence.Variant(v))
+	}
+
+	return persistence.Shortlink{
+		Domain:         domain,
+		Code:           code,
+		URL:            shortlink.URL,
+		TTL:            shortlink.TTL,
+		ActiveFrom:     shortlink.ActiveFrom,
+		Schedule:       schedule,
+		Rules:          rules,
+		Variants:       variants,
+		StickyVariants: shortlink.StickyVariants,
+		Campaign:       campaignToGeneric(shortlink.Campaign),
+		RedirectStatus: shortlink.RedirectStatus,
+		Passthrough:    shortlink.Passthrough,
+		Template:       shortlink.Template,
+		Title:          shortlink.Title,
+		Interstitial:   shortlink.Interstitial,
+		Warning:        shortlink.Warning,
+		PasswordHash:   shortlink.PasswordHash,
+		Internal:       shortlink.Internal,
+		Health:         healthToGeneric(shortlink.Health),
+	}
+}
+
+func campaignFromGeneric(campaign persistence.Campaign) *Campaign {
+	if campaign == (persistence.Campaign{}) {
+		return nil
+	}
+	c := Campaign(campaign)
+	return &c
+}
+
+func campaignToGeneric(campaign *Campaign) persistence.Campaign {
+	if campaign == nil {
+		return persistence.Campaign{}
+	}
+	return persistence.Campaign(*campaign)
+}
+
+func healthFromGeneric(health persistence.Health) *Health {
+	if health.CheckedAt.IsZero() {
+		return nil
+	}
+	return &Health{
+		CheckedAt:           health.CheckedAt,
+		StatusCode:          health.StatusCode,
+		Latency:             health.Latency,
+		Error:               health.Error,
+		ConsecutiveFailures: health.ConsecutiveFailures,
+	}
+}
+
+func healthToGeneric(health *Health) persistence.Health {
+	if health == nil {
+		return persistence.Health{}
+	}
+	return persistence.Health{
+		CheckedAt:           health.CheckedAt,
+		StatusCode:          health.StatusCode,
+		Latency:             health.Latency,
+		Error:               health.Error,
+		ConsecutiveFailures: health.ConsecutiveFailures,
+	}
+}
+
+func encodeShortlink(shortlink persistence.Shortlink) (*badger.Entry, error) {
+	val, err := json.Marshal(fromGeneric(shortlink))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := badger.NewEntry([]byte(persistence.Key(shortlink.Domain, shortlink.Code)), val)
+	if !shortlink.TTL.IsZero() {
+		entry = entry.WithTTL(shortlink.TTL.Sub(time.Now()))
+	}
+	return entry, nil
+}
+
+func decodeShortlink(item *badger.Item) (persistence.Shortlink, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return persistence.Shortlink{}, err
+	}
+
+	key := string(item.KeyCopy(nil))
+
+	// Entries written by older versions only contain the destination URL
+	if isLegacyValue(val) {
+		domain, code := persistence.SplitKey(key)
+		return persistence.Shortlink{
+			Domain: domain,
+			Code:   code,
+			URL:    string(val),
+			TTL:    expiresAt(item),
+		}, nil
+	}
+
+	var shortlink Shortlink
+	err = json.Unmarshal(val, &shortlink)
+	if err != nil {
+		return persistence.Shortlink{}, err
+	}
+	return toGeneric(key, shortlink), nil
+}
+
+func isLegacyValue(val []byte) bool {
+	return !bytes.HasPrefix(val, []byte("{"))
+}
+
+func decodeTrashed(item *badger.Item) (persistence.TrashedShortlink, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return persistence.TrashedShortlink{}, err
+	}
+
+	var trashed TrashedShortlink
+	err = json.Unmarshal(val, &trashed)
+	if err != nil {
+		return persistence.TrashedShortlink{}, err
+	}
+
+	key, id := splitTrashKey(string(item.Key()))
+	return persistence.TrashedShortlink{
+		Shortlink: toGeneric(key, trashed.Shortlink),
+		ID:        id,
+		DeletedAt: trashed.DeletedAt,
+	}, nil
+}
+
+func decodeRevision(key string, item *badger.Item) (persistence.Revision, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return persistence.Revision{}, err
+	}
+
+	var revision Revision
+	err = json.Unmarshal(val, &revision)
+	if err != nil {
+		return persistence.Revision{}, err
+	}
+
+	return persistence.Revision{
+		Shortlink: toGeneric(key, revision.Shortlink),
+		ID:        strings.TrimPrefix(string(item.Key()), string(revisionKey(key, ""))),
+		Editor:    revision.Editor,
+		CreatedAt: revision.CreatedAt,
+	}, nil
+}
+
+func decodeAlias(item *badger.Item) (persistence.Alias, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return persistence.Alias{}, err
+	}
+
+	var alias Alias
+	err = json.Unmarshal(val, &alias)
+	if err != nil {
+		return persistence.Alias{}, err
+	}
+
+	domain, code := persistence.SplitKey(strings.TrimPrefix(string(item.Key()), aliasKeyPrefix))
+	return persistence.Alias{
+		Domain: domain,
+		Code:   code,
+		Target: alias.Target,
+	}, nil
+}
+
+func expiresAt(item *badger.Item) time.Time {
+	if item.ExpiresAt() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(item.ExpiresAt()), 0).UTC()
+}
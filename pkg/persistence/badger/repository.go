@@ -1,11 +1,15 @@
 package badger
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/patrick246/shortlink/pkg/observability/logging"
 	"github.com/patrick246/shortlink/pkg/persistence"
 	"github.com/patrick246/shortlink/pkg/vars"
+	"strings"
 	"time"
 )
 
@@ -14,10 +18,14 @@ type Repository struct {
 	gcTicker *time.Ticker
 }
 
-type Shortlink struct {
-	URL string    `json:"url"`
-	TTL time.Time `json:"ttl"`
-}
+// Keys starting with the internal prefix are never valid codes, '#' can't be part of a URL path
+const internalKeyPrefix = "#"
+const trashKeyPrefix = internalKeyPrefix + "trash/"
+const revisionKeyPrefix = internalKeyPrefix + "revision/"
+const certificateKeyPrefix = internalKeyPrefix + "certificate/"
+const aliasKeyPrefix = internalKeyPrefix + "alias/"
+const namespaceKeyPrefix = internalKeyPrefix + "namespace/"
+const migrationKeyPrefix = internalKeyPrefix + "migration/"
 
 var log = logging.CreateLogger("local-storage")
 
@@ -41,10 +49,11 @@ func New(path string) (*Repository, error) {
 	}, nil
 }
 
-func (r *Repository) GetEntryForCode(_ context.Context, code string) (persistence.Shortlink, error) {
+func (r *Repository) GetEntryForCode(_ context.Context, domain, code string) (persistence.Shortlink, error) {
+	key := persistence.Key(domain, code)
 	shortlink := persistence.Shortlink{}
 	err := r.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(code))
+		item, err := txn.Get([]byte(key))
 		if err == badger.ErrKeyNotFound {
 			return persistence.ErrNotFound
 		}
@@ -52,42 +61,31 @@ func (r *Repository) GetEntryForCode(_ context.Context, code string) (persistenc
 			return err
 		}
 
-		var ttl time.Time
-		if item.ExpiresAt() != 0 {
-			ttl = time.Unix(int64(item.ExpiresAt()), 0).UTC()
-		}
-
-		val, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		shortlink = persistence.Shortlink{
-			Code: code,
-			URL:  string(val),
-			TTL:  ttl,
-		}
-		return nil
+		shortlink, err = decodeShortlink(item)
+		return err
 	})
 	return shortlink, err
 }
 
 func (r *Repository) SetEntry(_ context.Context, shortlink persistence.Shortlink) error {
+	entry, err := encodeShortlink(shortlink)
+	if err != nil {
+		return err
+	}
+
 	return r.db.Update(func(txn *badger.Txn) error {
-		entry := badger.NewEntry([]byte(shortlink.Code), []byte(shortlink.URL))
-		if !shortlink.TTL.IsZero() {
-			entry = entry.WithTTL(shortlink.TTL.Sub(time.Now()))
-		}
 		return txn.SetEntry(entry)
 	})
 }
 
-func (r *Repository) DeleteCode(_ context.Context, code string) error {
+func (r *Repository) DeleteCode(_ context.Context, domain, code string) error {
+	key := persistence.Key(domain, code)
 	return r.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(code))
+		return txn.Delete([]byte(key))
 	})
 }
 
-func (r *Repository) GetEntries(_ context.Context, page, size int64) ([]persistence.Shortlink, int64, error) {
+func (r *Repository) GetEntries(_ context.Context, filter persistence.Filter, page, size int64) ([]persistence.Shortlink, int64, error) {
 	var shortlinks []persistence.Shortlink
 	var total int64
 
@@ -100,26 +98,244 @@ func (r *Repository) GetEntries(_ context.Context, page, size int64) ([]persiste
 		skip := page * size
 		i := int64(0)
 		for it.Rewind(); it.Valid(); it.Next() {
+			if isInternalKey(it.Item().Key()) {
+				continue
+			}
+
+			domain, code := persistence.SplitKey(string(it.Item().Key()))
+			sl := persistence.Shortlink{Domain: domain, Code: code}
+			decoded := !filter.KeyOnly()
+			if decoded {
+				var err error
+				sl, err = decodeShortlink(it.Item())
+				if err != nil {
+					return err
+				}
+			}
+
+			if !filter.Matches(sl) {
+				continue
+			}
+
 			if i < skip || i >= skip+size {
 				i++
 				continue
 			}
 
-			item := it.Item()
-			var ttl time.Time
-			if item.ExpiresAt() != 0 {
-				ttl = time.Unix(int64(item.ExpiresAt()), 0).UTC()
+			if !decoded {
+				var err error
+				sl, err = decodeShortlink(it.Item())
+				if err != nil {
+					return err
+				}
 			}
+			shortlinks = append(shortlinks, sl)
+			i++
+		}
+		total = i
+		return nil
+	})
+	return shortlinks, total, err
+}
+
+func (r *Repository) UpdateHealth(_ context.Context, checked persistence.Shortlink, health persistence.Health) error {
+	key := persistence.Key(checked.Domain, checked.Code)
+	return r.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		shortlink, err := decodeShortlink(item)
+		if err != nil {
+			return err
+		}
+		if !shortlink.SameDestinations(checked) {
+			return persistence.ErrConflict
+		}
+		shortlink.Health = health
+
+		entry, err := encodeShortlink(shortlink)
+		if err != nil {
+			return err
+		}
+		return txn.SetEntry(entry)
+	})
+}
 
-			url, err := item.ValueCopy(nil)
+func (r *Repository) RenameCode(_ context.Context, domain, code, newDomain, newCode string) error {
+	key := persistence.Key(domain, code)
+	newKey := persistence.Key(newDomain, newCode)
+	return r.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		inUse, err := codeInUse(txn, newKey)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return persistence.ErrConflict
+		}
+
+		shortlink, err := decodeShortlink(item)
+		if err != nil {
+			return err
+		}
+		shortlink.Domain = newDomain
+		shortlink.Code = newCode
+
+		entry, err := encodeShortlink(shortlink)
+		if err != nil {
+			return err
+		}
+		err = txn.SetEntry(entry)
+		if err != nil {
+			return err
+		}
+		err = txn.Delete([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		err = moveRevisions(txn, key, newKey)
+		if err != nil {
+			return err
+		}
+
+		aliases, err := findAliases(txn, domain, code)
+		if err != nil {
+			return err
+		}
+		for _, alias := range aliases {
+			aliasKey := persistence.Key(alias.Domain, alias.Code)
+			newAliasKey := persistence.Key(newDomain, alias.Code)
+			if newAliasKey != aliasKey {
+				err = txn.Delete([]byte(aliasKeyPrefix + aliasKey))
+				if err != nil {
+					return err
+				}
+
+				inUse, err := codeInUse(txn, newAliasKey)
+				if err != nil {
+					return err
+				}
+				if inUse {
+					log.Warnw("dropping alias, the code is already in use on the new domain", "domain", newDomain, "code", alias.Code, "target", newCode)
+					continue
+				}
+			}
+
+			encoded, err := json.Marshal(Alias{
+				Target: newCode,
+			})
+			if err != nil {
+				return err
+			}
+			err = txn.Set([]byte(aliasKeyPrefix+newAliasKey), encoded)
 			if err != nil {
 				return err
 			}
+		}
+		return nil
+	})
+}
 
-			sl := persistence.Shortlink{
-				Code: string(item.KeyCopy(nil)),
-				URL:  string(url),
-				TTL:  ttl,
+// codeInUse checks shortlinks and aliases, both share the same codes
+func codeInUse(txn *badger.Txn, key string) (bool, error) {
+	for _, used := range []string{key, aliasKeyPrefix + key} {
+		_, err := txn.Get([]byte(used))
+		if err == nil {
+			return true, nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (r *Repository) TrashCode(_ context.Context, domain, code string) error {
+	key := persistence.Key(domain, code)
+	return r.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		shortlink, err := decodeShortlink(item)
+		if err != nil {
+			return err
+		}
+
+		deletedAt := time.Now().UTC()
+		trashed, err := json.Marshal(TrashedShortlink{
+			Shortlink: fromGeneric(shortlink),
+			DeletedAt: deletedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = txn.Set(trashKey(key, fmt.Sprintf("%019d", deletedAt.UnixNano())), trashed)
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (r *Repository) GetTrashedEntries(_ context.Context, filter persistence.Filter, page, size int64) ([]persistence.TrashedShortlink, int64, error) {
+	var shortlinks []persistence.TrashedShortlink
+	var total int64
+
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(trashKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		skip := page * size
+		i := int64(0)
+		for it.Rewind(); it.Valid(); it.Next() {
+			key, id := splitTrashKey(string(it.Item().Key()))
+			domain, code := persistence.SplitKey(key)
+			sl := persistence.TrashedShortlink{Shortlink: persistence.Shortlink{Domain: domain, Code: code}, ID: id}
+			decoded := !filter.KeyOnly()
+			if decoded {
+				var err error
+				sl, err = decodeTrashed(it.Item())
+				if err != nil {
+					return err
+				}
+			}
+
+			if !filter.Matches(sl.Shortlink) {
+				continue
+			}
+
+			if i < skip || i >= skip+size {
+				i++
+				continue
+			}
+
+			if !decoded {
+				var err error
+				sl, err = decodeTrashed(it.Item())
+				if err != nil {
+					return err
+				}
 			}
 			shortlinks = append(shortlinks, sl)
 			i++
@@ -130,7 +346,327 @@ func (r *Repository) GetEntries(_ context.Context, page, size int64) ([]persiste
 	return shortlinks, total, err
 }
 
-func (r *Repository) Migrate(_ context.Context) error {
+func (r *Repository) RestoreCode(_ context.Context, domain, code, id string) error {
+	key := persistence.Key(domain, code)
+	return r.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(trashKey(key, id))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		trashed, err := decodeTrashed(item)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.Get([]byte(key))
+		if err == nil {
+			return persistence.ErrConflict
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		entry, err := encodeShortlink(trashed.Shortlink)
+		if err != nil {
+			return err
+		}
+		err = txn.SetEntry(entry)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(item.KeyCopy(nil))
+	})
+}
+
+func (r *Repository) PurgeCode(_ context.Context, domain, code, id string) error {
+	key := persistence.Key(domain, code)
+	return r.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(trashKey(key, id))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		err = txn.Delete(trashKey(key, id))
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.Get([]byte(key))
+		if err == nil {
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		// The revisions and aliases belong to the other versions as well
+		trashed, err := inTrash(txn, key)
+		if err != nil || trashed {
+			return err
+		}
+
+		err = deleteRevisions(txn, key)
+		if err != nil {
+			return err
+		}
+		return deleteAliases(txn, domain, code)
+	})
+}
+
+func (r *Repository) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	var expired []persistence.TrashedShortlink
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(trashKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			trashed, err := decodeTrashed(it.Item())
+			if err != nil {
+				return err
+			}
+
+			if trashed.DeletedAt.Before(deletedBefore) {
+				expired = append(expired, trashed)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, trashed := range expired {
+		log.Infow("purging trashed code", "code", trashed.Code, "dest", trashed.URL, "deletedAt", trashed.DeletedAt)
+		err = r.PurgeCode(ctx, trashed.Domain, trashed.Code, trashed.ID)
+		// Purged concurrently, e.g. by another replica
+		if err == persistence.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (r *Repository) AddRevision(_ context.Context, revision persistence.Revision) error {
+	if revision.CreatedAt.IsZero() {
+		revision.CreatedAt = time.Now().UTC()
+	}
+	if revision.ID == "" {
+		revision.ID = fmt.Sprintf("%019d", revision.CreatedAt.UnixNano())
+	}
+
+	encoded, err := json.Marshal(Revision{
+		Shortlink: fromGeneric(revision.Shortlink),
+		Editor:    revision.Editor,
+		CreatedAt: revision.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(revisionKey(persistence.Key(revision.Domain, revision.Code), revision.ID), encoded)
+	})
+}
+
+func (r *Repository) GetRevisions(_ context.Context, domain, code string) ([]persistence.Revision, error) {
+	key := persistence.Key(domain, code)
+	var revisions []persistence.Revision
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = revisionKey(key, "")
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Reverse iteration has to start at the last possible key with the prefix
+		for it.Seek(append(revisionKey(key, ""), 0xFF)); it.Valid(); it.Next() {
+			revision, err := decodeRevision(key, it.Item())
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, revision)
+		}
+		return nil
+	})
+	return revisions, err
+}
+
+func (r *Repository) GetRevision(_ context.Context, domain, code, id string) (persistence.Revision, error) {
+	key := persistence.Key(domain, code)
+	var revision persistence.Revision
+	err := r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(revisionKey(key, id))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		revision, err = decodeRevision(key, item)
+		return err
+	})
+	return revision, err
+}
+
+func (r *Repository) GetAlias(_ context.Context, domain, code string) (persistence.Alias, error) {
+	var alias persistence.Alias
+	err := r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(aliasKeyPrefix + persistence.Key(domain, code)))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		alias, err = decodeAlias(item)
+		return err
+	})
+	return alias, err
+}
+
+func (r *Repository) SetAlias(_ context.Context, alias persistence.Alias) error {
+	encoded, err := json.Marshal(Alias{
+		Target: alias.Target,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(aliasKeyPrefix+persistence.Key(alias.Domain, alias.Code)), encoded)
+	})
+}
+
+func (r *Repository) DeleteAlias(_ context.Context, domain, code string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(aliasKeyPrefix + persistence.Key(domain, code)))
+	})
+}
+
+func (r *Repository) GetAliases(_ context.Context, domain, target string) ([]persistence.Alias, error) {
+	var aliases []persistence.Alias
+	err := r.db.View(func(txn *badger.Txn) error {
+		var err error
+		aliases, err = findAliases(txn, domain, target)
+		return err
+	})
+	return aliases, err
+}
+
+func (r *Repository) GetAllAliases(_ context.Context) ([]persistence.Alias, error) {
+	var aliases []persistence.Alias
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(aliasKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			alias, err := decodeAlias(it.Item())
+			if err != nil {
+				return err
+			}
+			aliases = append(aliases, alias)
+		}
+		return nil
+	})
+	return aliases, err
+}
+
+func (r *Repository) GetNamespaces(_ context.Context) ([]persistence.Namespace, error) {
+	var namespaces []persistence.Namespace
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(namespaceKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			var namespace Namespace
+			err = json.Unmarshal(val, &namespace)
+			if err != nil {
+				return err
+			}
+
+			namespaces = append(namespaces, persistence.Namespace{
+				Prefix:  strings.TrimPrefix(string(it.Item().Key()), namespaceKeyPrefix),
+				Members: namespace.Members,
+			})
+		}
+		return nil
+	})
+	return namespaces, err
+}
+
+func (r *Repository) SetNamespace(_ context.Context, namespace persistence.Namespace) error {
+	encoded, err := json.Marshal(Namespace{
+		Members: namespace.Members,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(namespaceKeyPrefix+namespace.Prefix), encoded)
+	})
+}
+
+func (r *Repository) DeleteNamespace(_ context.Context, prefix string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(namespaceKeyPrefix + prefix))
+	})
+}
+
+func (r *Repository) GetCertificateData(_ context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(certificateKeyPrefix + key))
+		if err == badger.ErrKeyNotFound {
+			return persistence.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	return data, err
+}
+
+func (r *Repository) SetCertificateData(_ context.Context, key string, data []byte) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(certificateKeyPrefix+key), data)
+	})
+}
+
+func (r *Repository) DeleteCertificateData(_ context.Context, key string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(certificateKeyPrefix + key))
+	})
+}
+
+func (r *Repository) Migrate(ctx context.Context, defaultDomain string) error {
 	err := r.db.Update(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = true
@@ -138,7 +674,12 @@ func (r *Repository) Migrate(_ context.Context) error {
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
-			if !vars.ValidCodePattern.Match(item.Key()) {
+			if isInternalKey(item.Key()) {
+				continue
+			}
+
+			_, code := persistence.SplitKey(string(item.Key()))
+			if !vars.ValidCodePattern.MatchString(code) {
 				dest, err := item.ValueCopy(nil)
 				if err != nil {
 					log.Errorw("error reading old code data", "error", err)
@@ -148,6 +689,12 @@ func (r *Repository) Migrate(_ context.Context) error {
 				if err != nil {
 					return err
 				}
+				continue
+			}
+
+			err := migrateLegacyValue(txn, item)
+			if err != nil {
+				return err
 			}
 		}
 		return nil
@@ -155,6 +702,290 @@ func (r *Repository) Migrate(_ context.Context) error {
 	if err != nil {
 		return err
 	}
+
+	if defaultDomain == "" {
+		return nil
+	}
+	return r.migrateDomain(ctx, defaultDomain)
+}
+
+func (r *Repository) MigrationDone(_ context.Context, name string) (bool, error) {
+	err := r.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(migrationKeyPrefix + name))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *Repository) SetMigrationDone(_ context.Context, name string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(migrationKeyPrefix+name), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(internalKeyPrefix))
+}
+
+// revisionKey sorts the revisions of a shortlink chronologically, IDs are zero-padded timestamps
+func revisionKey(key, id string) []byte {
+	return []byte(revisionKeyPrefix + key + internalKeyPrefix + id)
+}
+
+// trashKey keeps the versions of a code trashed several times apart, shortlinks trashed before IDs existed have none
+func trashKey(key, id string) []byte {
+	if id == "" {
+		return []byte(trashKeyPrefix + key)
+	}
+	return []byte(trashKeyPrefix + key + internalKeyPrefix + id)
+}
+
+// splitTrashKey returns the key of the trashed shortlink and the ID of the trash entry
+func splitTrashKey(trashKey string) (key, id string) {
+	key = strings.TrimPrefix(trashKey, trashKeyPrefix)
+	if i := strings.LastIndex(key, internalKeyPrefix); i != -1 {
+		return key[:i], key[i+len(internalKeyPrefix):]
+	}
+	return key, ""
+}
+
+// inTrash checks whether any version of the shortlink is in the trash
+func inTrash(txn *badger.Txn, key string) (bool, error) {
+	_, err := txn.Get(trashKey(key, ""))
+	if err == nil {
+		return true, nil
+	}
+	if err != badger.ErrKeyNotFound {
+		return false, err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(trashKeyPrefix + key + internalKeyPrefix)
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	it.Rewind()
+	return it.Valid(), nil
+}
+
+// migrateLegacyValue rewrites entries only containing the destination URL to the current format
+func migrateLegacyValue(txn *badger.Txn, item *badger.Item) error {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if !isLegacyValue(val) {
+		return nil
+	}
+
+	shortlink, err := decodeShortlink(item)
+	if err != nil {
+		return err
+	}
+
+	log.Infow("converting legacy entry", "reason", "migration", "code", shortlink.Code)
+	entry, err := encodeShortlink(shortlink)
+	if err != nil {
+		return err
+	}
+	return txn.SetEntry(entry)
+}
+
+// migrateDomain moves shortlinks, trashed shortlinks, aliases and revisions without a domain to the default domain. The
+// entries are moved in batches, a single transaction would be too large for bigger stores. Moved entries have a domain,
+// so an interrupted migration continues with the remaining ones.
+func (r *Repository) migrateDomain(ctx context.Context, defaultDomain string) error {
+	migration := "default-domain/" + defaultDomain
+	done, err := r.MigrationDone(ctx, migration)
+	if err != nil || done {
+		return err
+	}
+
+	var after []byte
+	for {
+		var entries []legacyEntry
+		entries, after, err = r.legacyEntries(after, defaultDomain)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		err = r.db.Update(func(txn *badger.Txn) error {
+			for _, legacy := range entries {
+				log.Infow("moving entry to default domain", "reason", "migration", "key", legacy.key, "domain", defaultDomain)
+				entry := badger.NewEntry([]byte(legacy.newKey), legacy.val)
+				entry.ExpiresAt = legacy.expiresAt
+				err := txn.SetEntry(entry)
+				if err != nil {
+					return err
+				}
+
+				err = txn.Delete([]byte(legacy.key))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return r.SetMigrationDone(ctx, migration)
+}
+
+// domainMigrationBatch is the number of entries moved to the default domain in one transaction
+const domainMigrationBatch = 1000
+
+type legacyEntry struct {
+	key       string
+	newKey    string
+	val       []byte
+	expiresAt uint64
+}
+
+// legacyEntries returns the next batch of entries without a domain after the given key, and the key to continue after
+func (r *Repository) legacyEntries(after []byte, defaultDomain string) ([]legacyEntry, []byte, error) {
+	var entries []legacyEntry
+	err := r.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(after); it.Valid() && len(entries) < domainMigrationBatch; it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+			after = item.KeyCopy(nil)
+			newKey := defaultDomainKey(key, defaultDomain)
+			if newKey == "" {
+				continue
+			}
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, legacyEntry{key: key, newKey: newKey, val: val, expiresAt: item.ExpiresAt()})
+		}
+		return nil
+	})
+	return entries, after, err
+}
+
+// defaultDomainKey returns the key of an entry on the default domain, it is empty for entries that already have a domain
+// or don't belong to one
+func defaultDomainKey(key, defaultDomain string) string {
+	if domain, _ := persistence.SplitKey(key); domain != "" || strings.HasPrefix(key, certificateKeyPrefix) {
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(key, trashKeyPrefix):
+		return trashKeyPrefix + persistence.Key(defaultDomain, strings.TrimPrefix(key, trashKeyPrefix))
+	case strings.HasPrefix(key, revisionKeyPrefix):
+		return revisionKeyPrefix + persistence.Key(defaultDomain, strings.TrimPrefix(key, revisionKeyPrefix))
+	case strings.HasPrefix(key, aliasKeyPrefix):
+		return aliasKeyPrefix + persistence.Key(defaultDomain, strings.TrimPrefix(key, aliasKeyPrefix))
+	case isInternalKey([]byte(key)):
+		return ""
+	default:
+		return persistence.Key(defaultDomain, key)
+	}
+}
+
+// moveRevisions rekeys the revisions of a shortlink, the code of the shortlink in a revision is derived from its key
+func moveRevisions(txn *badger.Txn, key, newKey string) error {
+	type revisionEntry struct {
+		id  string
+		val []byte
+	}
+	var revisions []revisionEntry
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = revisionKey(key, "")
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return err
+		}
+		id := strings.TrimPrefix(string(it.Item().Key()), string(revisionKey(key, "")))
+		revisions = append(revisions, revisionEntry{id: id, val: val})
+	}
+	it.Close()
+
+	for _, revision := range revisions {
+		err := txn.Set(revisionKey(newKey, revision.id), revision.val)
+		if err != nil {
+			return err
+		}
+		err = txn.Delete(revisionKey(key, revision.id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteRevisions(txn *badger.Txn, key string) error {
+	var keys [][]byte
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = revisionKey(key, "")
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for _, key := range keys {
+		err := txn.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findAliases iterates over all aliases, there are few of them compared to the shortlinks. Keys are sorted, so the
+// aliases are sorted by code within a domain.
+func findAliases(txn *badger.Txn, domain, target string) ([]persistence.Alias, error) {
+	var aliases []persistence.Alias
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(aliasKeyPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		alias, err := decodeAlias(it.Item())
+		if err != nil {
+			return nil, err
+		}
+
+		if alias.Domain == domain && alias.Target == target {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases, nil
+}
+
+func deleteAliases(txn *badger.Txn, domain, target string) error {
+	aliases, err := findAliases(txn, domain, target)
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		err = txn.Delete([]byte(aliasKeyPrefix + persistence.Key(alias.Domain, alias.Code)))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,195 @@
+package badger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/patrick246/shortlink/pkg/persistence"
+)
+
+func newRepository(t *testing.T) *Repository {
+	repo, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+	return repo
+}
+
+func setEntries(t *testing.T, repo *Repository, shortlinks ...persistence.Shortlink) {
+	for _, shortlink := range shortlinks {
+		err := repo.SetEntry(context.Background(), shortlink)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// trashTwice creates, trashes, recreates and trashes the code again, the versions are returned in the order of deletion
+func trashTwice(t *testing.T, repo *Repository, code string) []persistence.TrashedShortlink {
+	ctx := context.Background()
+	for _, url := range []string{"https://example.com/first", "https://example.com/second"} {
+		err := repo.SetEntry(ctx, persistence.Shortlink{Code: code, URL: url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.AddRevision(ctx, persistence.Revision{Shortlink: persistence.Shortlink{Code: code, URL: url}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.TrashCode(ctx, "", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trashed, total, err := repo.GetTrashedEntries(ctx, persistence.Filter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(trashed) != 2 {
+		t.Fatalf("expected both versions in the trash, got %+v", trashed)
+	}
+	if trashed[0].ID == "" || trashed[0].ID == trashed[1].ID {
+		t.Fatalf("expected distinct trash IDs, got %q and %q", trashed[0].ID, trashed[1].ID)
+	}
+	return trashed
+}
+
+func TestTrashKeepsEveryVersion(t *testing.T) {
+	repo := newRepository(t)
+	ctx := context.Background()
+	trashed := trashTwice(t, repo, "meet")
+	if trashed[0].URL != "https://example.com/first" || trashed[1].URL != "https://example.com/second" {
+		t.Fatalf("expected the first and the second version, got %s and %s", trashed[0].URL, trashed[1].URL)
+	}
+
+	err := repo.RestoreCode(ctx, "", "meet", trashed[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := repo.GetEntryForCode(ctx, "", "meet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.URL != "https://example.com/first" {
+		t.Errorf("expected the first version to be restored, got %s", restored.URL)
+	}
+
+	err = repo.RestoreCode(ctx, "", "meet", trashed[1].ID)
+	if err != persistence.ErrConflict {
+		t.Errorf("expected a conflict restoring the second version over the first, got %v", err)
+	}
+
+	remaining, _, err := repo.GetTrashedEntries(ctx, persistence.Filter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != trashed[1].ID {
+		t.Errorf("expected the second version to stay in the trash, got %+v", remaining)
+	}
+}
+
+func TestPurgeKeepsRevisionsOfOtherVersions(t *testing.T) {
+	repo := newRepository(t)
+	ctx := context.Background()
+	trashed := trashTwice(t, repo, "meet")
+
+	err := repo.PurgeCode(ctx, "", "meet", trashed[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.PurgeCode(ctx, "", "meet", trashed[1].ID)
+	if err != persistence.ErrNotFound {
+		t.Errorf("expected the purged version to be gone, got %v", err)
+	}
+
+	revisions, err := repo.GetRevisions(ctx, "", "meet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Errorf("expected the revisions to be kept for the first version, got %d", len(revisions))
+	}
+
+	err = repo.PurgeCode(ctx, "", "meet", trashed[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisions, err = repo.GetRevisions(ctx, "", "meet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("expected the revisions to be purged with the last version, got %d", len(revisions))
+	}
+}
+
+func TestMigrateMovesEntriesToDefaultDomainInBatches(t *testing.T) {
+	repo := newRepository(t)
+	ctx := context.Background()
+	count := 2*domainMigrationBatch + 1
+	for i := 0; i < count; i++ {
+		code := fmt.Sprintf("code-%d", i)
+		setEntries(t, repo, persistence.Shortlink{Code: code, URL: "https://example.com/" + code})
+		err := repo.AddRevision(ctx, persistence.Revision{Shortlink: persistence.Shortlink{Code: code, URL: "https://example.com/" + code}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := repo.SetAlias(ctx, persistence.Alias{Code: "alias", Target: "code-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.TrashCode(ctx, "", "code-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.Migrate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, total, err := repo.GetEntries(ctx, persistence.Filter{Domain: "example.com"}, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != int64(count-1) {
+		t.Errorf("expected %d shortlinks on the default domain, got %d", count-1, total)
+	}
+	_, total, err = repo.GetEntries(ctx, persistence.Filter{}, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != int64(count-1) {
+		t.Errorf("expected no shortlinks left without a domain, got %d in total", total)
+	}
+
+	revisions, err := repo.GetRevisions(ctx, "example.com", fmt.Sprintf("code-%d", count-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("expected the revision to move along, got %d", len(revisions))
+	}
+	alias, err := repo.GetAlias(ctx, "example.com", "alias")
+	if err != nil || alias.Target != "code-0" {
+		t.Errorf("expected the alias on the default domain, got %+v, %v", alias, err)
+	}
+	trashed, _, err := repo.GetTrashedEntries(ctx, persistence.Filter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 1 || trashed[0].Domain != "example.com" || trashed[0].Code != "code-1" || trashed[0].ID == "" {
+		t.Errorf("expected the trashed shortlink on the default domain, got %+v", trashed)
+	}
+
+	done, err := repo.MigrationDone(ctx, "default-domain/example.com")
+	if err != nil || !done {
+		t.Errorf("expected the migration to be marked as done, got %v, %v", done, err)
+	}
+}
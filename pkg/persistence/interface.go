@@ -7,18 +7,189 @@ import (
 )
 
 var ErrNotFound = errors.New("not found")
+var ErrConflict = errors.New("code already exists")
 
 type Shortlink struct {
-	Code string
+	// Domain the code belongs to, the same code can have different destinations on each domain
+	Domain string
+	Code   string
+	URL    string
+	TTL    time.Time
+	// ActiveFrom is the time the shortlink goes live, it is active immediately if zero
+	ActiveFrom time.Time
+	// Schedule replaces URL once the time of a scheduled destination has been reached
+	Schedule []ScheduledDestination
+	// Rules send matching requests to their own destination, they are checked in order before the schedule
+	Rules []Rule
+	// Variants split the requests between several destinations by their weights, they replace URL and the schedule
+	Variants []Variant
+	// StickyVariants keeps clients on the variant they got first with a cookie
+	StickyVariants bool
+	// Campaign is added to the destination as UTM parameters when redirecting
+	Campaign Campaign
+	// RedirectStatus is the HTTP status code used for the redirect, the server default is used if zero
+	RedirectStatus int
+	// Passthrough appends the remaining request path and the query parameters to the destination
+	Passthrough bool
+	// Template fills placeholders in the destination from the remaining request path and the query parameters
+	Template bool
+	// Title describes the destination on the preview page
+	Title string
+	// Interstitial always shows the preview page with the warning before redirecting
+	Interstitial bool
+	Warning      string
+	// PasswordHash is the bcrypt hash of the password required to follow the shortlink, empty if none is required
+	PasswordHash string
+	// Internal requires the same login as the admin area before redirecting
+	Internal bool
+	// Health is the result of the last destination check, it is reset when the shortlink is changed
+	Health Health
+}
+
+type Health struct {
+	CheckedAt  time.Time
+	StatusCode int
+	Latency    time.Duration
+	// Error describes why the destination couldn't be reached, empty if there was a response
+	Error string
+	// ConsecutiveFailures counts the checks that failed since the destination was last reachable
+	ConsecutiveFailures int
+}
+
+type ScheduledDestination struct {
+	From time.Time
 	URL  string
-	TTL  time.Time
+}
+
+// Rule matches requests by the client, all conditions that are set have to match
+type Rule struct {
+	// Device is the platform of the user agent, e.g. ios or android, empty matches all devices
+	Device string
+	// Language is compared with the start of the most preferred language of the client, e.g. de matches de-AT
+	Language string
+	// Query requires a query parameter, written as name=value or just name if any value matches
+	Query string
+	URL   string
+}
+
+// Variant is one of the destinations of a split shortlink, it gets Weight out of the sum of all weights of the requests
+type Variant struct {
+	// Name identifies the variant in the metrics and the sticky cookie
+	Name   string
+	URL    string
+	Weight int
+}
+
+// Campaign holds the values of the utm_ query parameters, empty values are left out
+type Campaign struct {
+	Source  string
+	Medium  string
+	Name    string
+	Term    string
+	Content string
+}
+
+type TrashedShortlink struct {
+	Shortlink
+	// ID keeps the versions of a code deleted several times apart, it is empty for shortlinks trashed before IDs existed
+	ID        string
+	DeletedAt time.Time
+}
+
+// Filter restricts the shortlinks returned by GetEntries, the zero value matches all shortlinks
+type Filter struct {
+	// Prefix matches the start of the code on all domains, e.g. team/ for the hierarchical codes of a team
+	Prefix string
+	// Namespaces restricts the codes to the ones starting with any of the prefixes, nil doesn't restrict the codes
+	Namespaces []string
+	// Domain restricts the shortlinks to one domain, empty matches all domains
+	Domain string
+	// Search matches the code, the destination or the title case-insensitively
+	Search string
+	// Campaign matches the campaign name of the shortlinks exactly
+	Campaign string
+}
+
+// Namespace lets its members manage the codes starting with Prefix, e.g. team-a- or team-a/
+type Namespace struct {
+	Prefix string
+	// Members are user names, groups of the identity provider are prefixed with group:
+	Members []string
+}
+
+// Alias is an additional code for a shortlink, it always redirects like the current version of its target
+type Alias struct {
+	Domain string
+	Code   string
+	// Target is the code of the canonical shortlink, on the same domain as the alias
+	Target string
+}
+
+// Revision is a snapshot of a shortlink, recorded every time the shortlink is changed
+type Revision struct {
+	Shortlink
+	ID        string
+	Editor    string
+	CreatedAt time.Time
 }
 
 type Repository interface {
-	GetEntryForCode(ctx context.Context, code string) (Shortlink, error)
+	GetEntryForCode(ctx context.Context, domain, code string) (Shortlink, error)
 	SetEntry(ctx context.Context, shortlink Shortlink) error
-	DeleteCode(ctx context.Context, code string) error
-	GetEntries(ctx context.Context, page, size int64) ([]Shortlink, int64, error)
-	Migrate(ctx context.Context) error
+	DeleteCode(ctx context.Context, domain, code string) error
+	GetEntries(ctx context.Context, filter Filter, page, size int64) ([]Shortlink, int64, error)
+	// UpdateHealth only replaces the health of a shortlink, so concurrent changes of the shortlink are not overwritten.
+	// The checked shortlink is the version the health belongs to, returns ErrConflict if the destinations have changed
+	// since.
+	UpdateHealth(ctx context.Context, checked Shortlink, health Health) error
+	// RenameCode moves a shortlink to a new domain and code together with its revisions, its aliases target the new code
+	// afterwards. Returns ErrConflict if the new code is used by a shortlink or an alias. On a domain change the aliases
+	// move along, aliases whose code is already used on the new domain are dropped.
+	RenameCode(ctx context.Context, domain, code, newDomain, newCode string) error
+
+	// TrashCode moves a shortlink into the trash, from where it can be restored until it is purged.
+	TrashCode(ctx context.Context, domain, code string) error
+	GetTrashedEntries(ctx context.Context, filter Filter, page, size int64) ([]TrashedShortlink, int64, error)
+	// RestoreCode moves the trashed shortlink with the ID back. Returns ErrConflict if the code has been reused in the
+	// meantime.
+	RestoreCode(ctx context.Context, domain, code, id string) error
+	// PurgeCode removes the trashed shortlink with the ID, returns ErrNotFound if it isn't in the trash. Its revisions
+	// and aliases are removed too, unless the code has been reused by a live shortlink or another version is still in
+	// the trash.
+	PurgeCode(ctx context.Context, domain, code, id string) error
+	// PurgeTrash removes all trashed shortlinks deleted before the given time and returns the number of removed entries.
+	PurgeTrash(ctx context.Context, deletedBefore time.Time) (int64, error)
+
+	// AddRevision records a revision, ID and CreatedAt are assigned by the repository if empty.
+	AddRevision(ctx context.Context, revision Revision) error
+	// GetRevisions returns the revisions of a code, newest first.
+	GetRevisions(ctx context.Context, domain, code string) ([]Revision, error)
+	GetRevision(ctx context.Context, domain, code, id string) (Revision, error)
+
+	// Aliases share the codes of the shortlinks, the server makes sure a code isn't used by both.
+	// GetAlias returns ErrNotFound for unknown codes.
+	GetAlias(ctx context.Context, domain, code string) (Alias, error)
+	SetAlias(ctx context.Context, alias Alias) error
+	DeleteAlias(ctx context.Context, domain, code string) error
+	// GetAliases returns the aliases of the target code, sorted by code.
+	GetAliases(ctx context.Context, domain, target string) ([]Alias, error)
+	GetAllAliases(ctx context.Context) ([]Alias, error)
+
+	// Namespaces are few, GetNamespaces returns all of them sorted by prefix.
+	GetNamespaces(ctx context.Context) ([]Namespace, error)
+	SetNamespace(ctx context.Context, namespace Namespace) error
+	DeleteNamespace(ctx context.Context, prefix string) error
+
+	// Certificate data stores ACME accounts, certificates and challenge tokens shared by all replicas.
+	// GetCertificateData returns ErrNotFound for unknown keys.
+	GetCertificateData(ctx context.Context, key string) ([]byte, error)
+	SetCertificateData(ctx context.Context, key string, data []byte) error
+	DeleteCertificateData(ctx context.Context, key string) error
+
+	// Migrate converts data of older versions, shortlinks without a domain are moved to the default domain.
+	Migrate(ctx context.Context, defaultDomain string) error
+	// Migrations running only once record their completion by name.
+	MigrationDone(ctx context.Context, name string) (bool, error)
+	SetMigrationDone(ctx context.Context, name string) error
 	Close() error
 }
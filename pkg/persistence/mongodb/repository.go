@@ -2,11 +2,14 @@ package mongodb
 
 import (
 	"context"
+	"github.com/google/uuid"
 	"github.com/patrick246/shortlink/pkg/persistence"
 	"github.com/patrick246/shortlink/pkg/vars"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -15,12 +18,110 @@ type Repository struct {
 }
 
 type Shortlink struct {
-	ID  string    `bson:"_id"`
-	URL string    `bson:"url"`
-	TTL time.Time `bson:"ttl"`
+	// ID is the key of the shortlink, it combines domain and code
+	ID             string                 `bson:"_id"`
+	Domain         string                 `bson:"domain,omitempty"`
+	URL            string                 `bson:"url"`
+	TTL            time.Time              `bson:"ttl,omitempty"`
+	ActiveFrom     time.Time              `bson:"activeFrom,omitempty"`
+	Schedule       []ScheduledDestination `bson:"schedule,omitempty"`
+	Rules          []Rule                 `bson:"rules,omitempty"`
+	Variants       []Variant              `bson:"variants,omitempty"`
+	StickyVariants bool                   `bson:"stickyVariants,omitempty"`
+	Campaign       *Campaign              `bson:"campaign,omitempty"`
+	RedirectStatus int                    `bson:"redirectStatus,omitempty"`
+	Passthrough    bool                   `bson:"passthrough,omitempty"`
+	Template       bool                   `bson:"template,omitempty"`
+	Title          string                 `bson:"title,omitempty"`
+	Interstitial   bool                   `bson:"interstitial,omitempty"`
+	Warning        string                 `bson:"warning,omitempty"`
+	PasswordHash   string                 `bson:"passwordHash,omitempty"`
+	Internal       bool                   `bson:"internal,omitempty"`
+	Health         *Health                `bson:"health,omitempty"`
+}
+
+type Health struct {
+	CheckedAt           time.Time     `bson:"checkedAt"`
+	StatusCode          int           `bson:"statusCode"`
+	Latency             time.Duration `bson:"latency"`
+	Error               string        `bson:"error,omitempty"`
+	ConsecutiveFailures int           `bson:"consecutiveFailures"`
+}
+
+type ScheduledDestination struct {
+	From time.Time `bson:"from"`
+	URL  string    `bson:"url"`
+}
+
+type Campaign struct {
+	Source  string `bson:"source,omitempty"`
+	Medium  string `bson:"medium,omitempty"`
+	Name    string `bson:"name,omitempty"`
+	Term    string `bson:"term,omitempty"`
+	Content string `bson:"content,omitempty"`
+}
+
+type Variant struct {
+	Name   string `bson:"name"`
+	URL    string `bson:"url"`
+	Weight int    `bson:"weight"`
+}
+
+type Rule struct {
+	Device   string `bson:"device,omitempty"`
+	Language string `bson:"language,omitempty"`
+	Query    string `bson:"query,omitempty"`
+	URL      string `bson:"url"`
+}
+
+// TrashedShortlink uses the key of the shortlink followed by the trash ID as _id, a code can be trashed several times
+type TrashedShortlink struct {
+	Shortlink `bson:",inline"`
+	TrashID   string    `bson:"trashId,omitempty"`
+	DeletedAt time.Time `bson:"deletedAt"`
+}
+
+type Revision struct {
+	ID string `bson:"_id"`
+	// Code is the key of the shortlink, it combines domain and code
+	Code      string    `bson:"code"`
+	Shortlink Shortlink `bson:"shortlink"`
+	Editor    string    `bson:"editor"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type Alias struct {
+	// ID is the key of the alias, it combines domain and code
+	ID     string `bson:"_id"`
+	Domain string `bson:"domain,omitempty"`
+	Target string `bson:"target"`
+}
+
+type Namespace struct {
+	Prefix  string   `bson:"_id"`
+	Members []string `bson:"members"`
+}
+
+type CertificateData struct {
+	Key  string `bson:"_id"`
+	Data []byte `bson:"data"`
+}
+
+type Migration struct {
+	Name        string    `bson:"_id"`
+	CompletedAt time.Time `bson:"completedAt"`
 }
 
 var codeCollection = "codes"
+var trashCollection = "trash"
+var revisionCollection = "revisions"
+var certificateCollection = "certificates"
+var aliasCollection = "aliases"
+var namespaceCollection = "namespaces"
+var migrationCollection = "migrations"
+
+// trashIDSeparator can't be part of codes or domains
+const trashIDSeparator = "#"
 
 func New(conn *Connection) (persistence.Repository, error) {
 	_, err := conn.Collection(codeCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
@@ -32,14 +133,45 @@ func New(conn *Connection) (persistence.Repository, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	_, err = conn.Collection(trashCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{
+			"deletedAt", 1,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Collection(revisionCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{
+			"code", 1,
+		}, {
+			"createdAt", -1,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Collection(aliasCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{
+			"target", 1,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &Repository{
 		conn: conn,
 	}, nil
 }
 
-func (r *Repository) GetEntryForCode(ctx context.Context, code string) (persistence.Shortlink, error) {
+func (r *Repository) GetEntryForCode(ctx context.Context, domain, code string) (persistence.Shortlink, error) {
+	key := persistence.Key(domain, code)
 	query := bson.D{{
-		"_id", code,
+		"_id", key,
 	}}
 	sr := r.conn.Collection(codeCollection).FindOne(ctx, query)
 
@@ -51,45 +183,21 @@ func (r *Repository) GetEntryForCode(ctx context.Context, code string) (persiste
 		return persistence.Shortlink{}, err
 	}
 
-	return persistence.Shortlink{
-		Code: entry.ID,
-		URL:  entry.URL,
-		TTL:  entry.TTL,
-	}, nil
+	return toGeneric(entry), nil
 }
 
 func (r *Repository) SetEntry(ctx context.Context, shortlink persistence.Shortlink) error {
-	var entry bson.D
-	if shortlink.TTL.IsZero() {
-		entry = bson.D{{
-			"$set", bson.D{{
-				"url", shortlink.URL,
-			}},
-		}, {
-			"$unset", bson.D{{
-				"ttl", "",
-			}},
-		}}
-	} else {
-		entry = bson.D{{
-			"$set", bson.D{{
-				"url", shortlink.URL,
-			}, {
-				"ttl", shortlink.TTL,
-			}},
-		}}
-	}
-
 	filter := bson.D{{
-		"_id", shortlink.Code,
+		"_id", persistence.Key(shortlink.Domain, shortlink.Code),
 	}}
 
-	_, err := r.conn.Collection(codeCollection).UpdateOne(ctx, filter, entry, options.Update().SetUpsert(true))
+	_, err := r.conn.Collection(codeCollection).ReplaceOne(ctx, filter, fromGeneric(shortlink), options.Replace().SetUpsert(true))
 	return err
 }
 
-func (r *Repository) GetEntries(ctx context.Context, page, size int64) ([]persistence.Shortlink, int64, error) {
-	res, err := r.conn.Collection(codeCollection).Find(ctx, bson.D{}, options.Find().SetLimit(size).SetSkip(page*size))
+func (r *Repository) GetEntries(ctx context.Context, filter persistence.Filter, page, size int64) ([]persistence.Shortlink, int64, error) {
+	query := filterQuery(filter)
+	res, err := r.conn.Collection(codeCollection).Find(ctx, query, options.Find().SetLimit(size).SetSkip(page*size))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -100,7 +208,7 @@ func (r *Repository) GetEntries(ctx context.Context, page, size int64) ([]persis
 		return nil, 0, err
 	}
 
-	total, err := r.conn.Collection(codeCollection).CountDocuments(ctx, bson.D{})
+	total, err := r.conn.Collection(codeCollection).CountDocuments(ctx, query)
 	generic := mapToGeneric(shortlinks)
 	if err != nil {
 		return generic, int64(len(shortlinks)), nil
@@ -109,15 +217,465 @@ func (r *Repository) GetEntries(ctx context.Context, page, size int64) ([]persis
 	return generic, total, nil
 }
 
-func (r *Repository) DeleteCode(ctx context.Context, code string) error {
-	_, err := r.conn.Collection(codeCollection).DeleteOne(ctx, bson.D{{"_id", code}})
+func (r *Repository) UpdateHealth(ctx context.Context, checked persistence.Shortlink, health persistence.Health) error {
+	key := persistence.Key(checked.Domain, checked.Code)
+	// The destinations are encoded like the stored ones, the update only matches if they haven't been changed. Empty
+	// lists are omitted when stored and encoded as null here, which matches missing fields.
+	destinations := fromGeneric(checked)
+	filter := bson.D{
+		{"_id", key},
+		{"url", destinations.URL},
+		{"schedule", destinations.Schedule},
+		{"rules", destinations.Rules},
+		{"variants", destinations.Variants},
+	}
+	update := bson.D{{
+		"$set", bson.D{{
+			"health", healthFromGeneric(health),
+		}},
+	}}
+
+	res, err := r.conn.Collection(codeCollection).UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 0 {
+		return nil
+	}
+
+	exists, err := r.conn.Collection(codeCollection).CountDocuments(ctx, bson.D{{"_id", key}})
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return persistence.ErrNotFound
+	}
+	return persistence.ErrConflict
+}
+
+func (r *Repository) DeleteCode(ctx context.Context, domain, code string) error {
+	key := persistence.Key(domain, code)
+	_, err := r.conn.Collection(codeCollection).DeleteOne(ctx, bson.D{{"_id", key}})
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	return err
+}
+
+func (r *Repository) RenameCode(ctx context.Context, domain, code, newDomain, newCode string) error {
+	entry, err := r.GetEntryForCode(ctx, domain, code)
+	if err != nil {
+		return err
+	}
+
+	newKey := persistence.Key(newDomain, newCode)
+	_, err = r.GetAlias(ctx, newDomain, newCode)
+	if err == nil {
+		return persistence.ErrConflict
+	} else if err != persistence.ErrNotFound {
+		return err
+	}
+
+	entry.Domain = newDomain
+	entry.Code = newCode
+	_, err = r.conn.Collection(codeCollection).InsertOne(ctx, fromGeneric(entry))
+	if mongo.IsDuplicateKeyError(err) {
+		return persistence.ErrConflict
+	} else if err != nil {
+		return err
+	}
+
+	_, err = r.conn.Collection(revisionCollection).UpdateMany(ctx, bson.D{{"code", persistence.Key(domain, code)}}, bson.D{{
+		"$set", bson.D{
+			{"code", newKey},
+			{"shortlink._id", newKey},
+			{"shortlink.domain", newDomain},
+		},
+	}})
+	if err != nil {
+		return err
+	}
+
+	aliases, err := r.GetAliases(ctx, domain, code)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if alias.Domain != newDomain {
+			err = r.DeleteAlias(ctx, alias.Domain, alias.Code)
+			if err != nil {
+				return err
+			}
+
+			inUse, err := r.codeInUse(ctx, newDomain, alias.Code)
+			if err != nil {
+				return err
+			}
+			if inUse {
+				log.Warnw("dropping alias, the code is already in use on the new domain", "domain", newDomain, "code", alias.Code, "target", newCode)
+				continue
+			}
+		}
+
+		alias.Domain = newDomain
+		alias.Target = newCode
+		err = r.SetAlias(ctx, alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.DeleteCode(ctx, domain, code)
+}
+
+// codeInUse checks shortlinks and aliases, both share the same codes
+func (r *Repository) codeInUse(ctx context.Context, domain, code string) (bool, error) {
+	_, err := r.GetEntryForCode(ctx, domain, code)
+	if err != persistence.ErrNotFound {
+		return err == nil, err
+	}
+
+	_, err = r.GetAlias(ctx, domain, code)
+	if err != persistence.ErrNotFound {
+		return err == nil, err
+	}
+	return false, nil
+}
+
+func (r *Repository) TrashCode(ctx context.Context, domain, code string) error {
+	entry, err := r.GetEntryForCode(ctx, domain, code)
+	if err != nil {
+		return err
+	}
+
+	trashed := TrashedShortlink{
+		Shortlink: fromGeneric(entry),
+		TrashID:   uuid.New().String(),
+		DeletedAt: time.Now().UTC(),
+	}
+	trashed.ID = trashDocumentID(trashed.ID, trashed.TrashID)
+
+	_, err = r.conn.Collection(trashCollection).InsertOne(ctx, trashed)
+	if err != nil {
+		return err
+	}
+
+	return r.DeleteCode(ctx, domain, code)
+}
+
+func (r *Repository) GetTrashedEntries(ctx context.Context, filter persistence.Filter, page, size int64) ([]persistence.TrashedShortlink, int64, error) {
+	query := filterQuery(filter)
+	findOptions := options.Find().SetSort(bson.D{{"deletedAt", -1}}).SetLimit(size).SetSkip(page * size)
+	res, err := r.conn.Collection(trashCollection).Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var trashed []TrashedShortlink
+	err = res.All(ctx, &trashed)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	generic := make([]persistence.TrashedShortlink, 0, len(trashed))
+	for _, t := range trashed {
+		generic = append(generic, trashedToGeneric(t))
+	}
+
+	total, err := r.conn.Collection(trashCollection).CountDocuments(ctx, query)
+	if err != nil {
+		return generic, int64(len(trashed)), nil
+	}
+
+	return generic, total, nil
+}
+
+func (r *Repository) RestoreCode(ctx context.Context, domain, code, id string) error {
+	key := persistence.Key(domain, code)
+	filter := bson.D{{"_id", trashDocumentID(key, id)}}
+
+	var trashed TrashedShortlink
+	err := r.conn.Collection(trashCollection).FindOne(ctx, filter).Decode(&trashed)
 	if err == mongo.ErrNoDocuments {
+		return persistence.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	trashed.Shortlink.ID = key
+	_, err = r.conn.Collection(codeCollection).InsertOne(ctx, trashed.Shortlink)
+	if mongo.IsDuplicateKeyError(err) {
+		return persistence.ErrConflict
+	} else if err != nil {
+		return err
+	}
+
+	// Only the trash entry is removed, the revisions and aliases belong to the restored shortlink
+	_, err = r.conn.Collection(trashCollection).DeleteOne(ctx, filter)
+	return err
+}
+
+func (r *Repository) PurgeCode(ctx context.Context, domain, code, id string) error {
+	key := persistence.Key(domain, code)
+	res, err := r.conn.Collection(trashCollection).DeleteOne(ctx, bson.D{{"_id", trashDocumentID(key, id)}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return persistence.ErrNotFound
+	}
+
+	// The revisions and aliases belong to the shortlink that reused the code
+	live, err := r.conn.Collection(codeCollection).CountDocuments(ctx, bson.D{{"_id", key}})
+	if err != nil {
+		return err
+	}
+	if live != 0 {
+		return nil
+	}
+
+	// The revisions and aliases belong to the other versions in the trash as well
+	versions := bson.D{{"_id", bson.D{{"$regex", "^" + regexp.QuoteMeta(key) + "(" + trashIDSeparator + "|$)"}}}}
+	trashed, err := r.conn.Collection(trashCollection).CountDocuments(ctx, versions)
+	if err != nil {
+		return err
+	}
+	if trashed != 0 {
 		return nil
 	}
+
+	_, err = r.conn.Collection(revisionCollection).DeleteMany(ctx, bson.D{{"code", key}})
+	if err != nil {
+		return err
+	}
+
+	aliases, err := r.GetAliases(ctx, domain, code)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		err = r.DeleteAlias(ctx, alias.Domain, alias.Code)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	filter := bson.D{{
+		"deletedAt", bson.D{{
+			"$lt", deletedBefore,
+		}},
+	}}
+
+	res, err := r.conn.Collection(trashCollection).Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []TrashedShortlink
+	err = res.All(ctx, &expired)
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, t := range expired {
+		trashed := trashedToGeneric(t)
+		log.Infow("purging trashed code", "domain", trashed.Domain, "code", trashed.Code, "dest", trashed.URL, "deletedAt", trashed.DeletedAt)
+		err = r.PurgeCode(ctx, trashed.Domain, trashed.Code, trashed.ID)
+		// Purged concurrently, e.g. by another replica
+		if err == persistence.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (r *Repository) AddRevision(ctx context.Context, revision persistence.Revision) error {
+	if revision.CreatedAt.IsZero() {
+		revision.CreatedAt = time.Now().UTC()
+	}
+	if revision.ID == "" {
+		revision.ID = uuid.New().String()
+	}
+
+	_, err := r.conn.Collection(revisionCollection).InsertOne(ctx, Revision{
+		ID:        revision.ID,
+		Code:      persistence.Key(revision.Domain, revision.Code),
+		Shortlink: fromGeneric(revision.Shortlink),
+		Editor:    revision.Editor,
+		CreatedAt: revision.CreatedAt,
+	})
+	return err
+}
+
+func (r *Repository) GetRevisions(ctx context.Context, domain, code string) ([]persistence.Revision, error) {
+	key := persistence.Key(domain, code)
+	findOptions := options.Find().SetSort(bson.D{{"createdAt", -1}})
+	res, err := r.conn.Collection(revisionCollection).Find(ctx, bson.D{{"code", key}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	err = res.All(ctx, &revisions)
+	if err != nil {
+		return nil, err
+	}
+
+	generic := make([]persistence.Revision, 0, len(revisions))
+	for _, revision := range revisions {
+		generic = append(generic, revisionToGeneric(revision))
+	}
+	return generic, nil
+}
+
+func (r *Repository) GetRevision(ctx context.Context, domain, code, id string) (persistence.Revision, error) {
+	key := persistence.Key(domain, code)
+	var revision Revision
+	err := r.conn.Collection(revisionCollection).FindOne(ctx, bson.D{{"_id", id}, {"code", key}}).Decode(&revision)
+	if err == mongo.ErrNoDocuments {
+		return persistence.Revision{}, persistence.ErrNotFound
+	} else if err != nil {
+		return persistence.Revision{}, err
+	}
+	return revisionToGeneric(revision), nil
+}
+
+func (r *Repository) GetAlias(ctx context.Context, domain, code string) (persistence.Alias, error) {
+	var alias Alias
+	err := r.conn.Collection(aliasCollection).FindOne(ctx, bson.D{{"_id", persistence.Key(domain, code)}}).Decode(&alias)
+	if err == mongo.ErrNoDocuments {
+		return persistence.Alias{}, persistence.ErrNotFound
+	} else if err != nil {
+		return persistence.Alias{}, err
+	}
+	return aliasToGeneric(alias), nil
+}
+
+func (r *Repository) SetAlias(ctx context.Context, alias persistence.Alias) error {
+	key := persistence.Key(alias.Domain, alias.Code)
+	_, err := r.conn.Collection(aliasCollection).ReplaceOne(ctx, bson.D{{"_id", key}}, Alias{
+		ID:     key,
+		Domain: alias.Domain,
+		Target: alias.Target,
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *Repository) DeleteAlias(ctx context.Context, domain, code string) error {
+	_, err := r.conn.Collection(aliasCollection).DeleteOne(ctx, bson.D{{"_id", persistence.Key(domain, code)}})
+	return err
+}
+
+func (r *Repository) GetAliases(ctx context.Context, domain, target string) ([]persistence.Alias, error) {
+	findOptions := options.Find().SetSort(bson.D{{"_id", 1}})
+	res, err := r.conn.Collection(aliasCollection).Find(ctx, bson.D{{"target", target}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []Alias
+	err = res.All(ctx, &aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aliases without a domain don't have the field, so the domain is compared after decoding
+	var generic []persistence.Alias
+	for _, alias := range aliases {
+		if a := aliasToGeneric(alias); a.Domain == domain {
+			generic = append(generic, a)
+		}
+	}
+	return generic, nil
+}
+
+func (r *Repository) GetAllAliases(ctx context.Context) ([]persistence.Alias, error) {
+	res, err := r.conn.Collection(aliasCollection).Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []Alias
+	err = res.All(ctx, &aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	generic := make([]persistence.Alias, 0, len(aliases))
+	for _, alias := range aliases {
+		generic = append(generic, aliasToGeneric(alias))
+	}
+	return generic, nil
+}
+
+func (r *Repository) GetNamespaces(ctx context.Context) ([]persistence.Namespace, error) {
+	res, err := r.conn.Collection(namespaceCollection).Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []Namespace
+	err = res.All(ctx, &namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	generic := make([]persistence.Namespace, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		generic = append(generic, persistence.Namespace{
+			Prefix:  namespace.Prefix,
+			Members: namespace.Members,
+		})
+	}
+	return generic, nil
+}
+
+func (r *Repository) SetNamespace(ctx context.Context, namespace persistence.Namespace) error {
+	_, err := r.conn.Collection(namespaceCollection).ReplaceOne(ctx, bson.D{{"_id", namespace.Prefix}}, Namespace{
+		Prefix:  namespace.Prefix,
+		Members: namespace.Members,
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *Repository) DeleteNamespace(ctx context.Context, prefix string) error {
+	_, err := r.conn.Collection(namespaceCollection).DeleteOne(ctx, bson.D{{"_id", prefix}})
 	return err
 }
 
-func (r *Repository) Migrate(ctx context.Context) error {
+func (r *Repository) GetCertificateData(ctx context.Context, key string) ([]byte, error) {
+	var certificateData CertificateData
+	err := r.conn.Collection(certificateCollection).FindOne(ctx, bson.D{{"_id", key}}).Decode(&certificateData)
+	if err == mongo.ErrNoDocuments {
+		return nil, persistence.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return certificateData.Data, nil
+}
+
+func (r *Repository) SetCertificateData(ctx context.Context, key string, data []byte) error {
+	_, err := r.conn.Collection(certificateCollection).ReplaceOne(ctx, bson.D{{"_id", key}}, CertificateData{
+		Key:  key,
+		Data: data,
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *Repository) DeleteCertificateData(ctx context.Context, key string) error {
+	_, err := r.conn.Collection(certificateCollection).DeleteOne(ctx, bson.D{{"_id", key}})
+	return err
+}
+
+func (r *Repository) Migrate(ctx context.Context, defaultDomain string) error {
 	cur, err := r.conn.Collection(codeCollection).Find(ctx, bson.D{})
 	if err != nil {
 		return err
@@ -131,7 +689,8 @@ func (r *Repository) Migrate(ctx context.Context) error {
 			return err
 		}
 
-		if !vars.ValidCodePattern.MatchString(doc.ID) {
+		_, code := persistence.SplitKey(doc.ID)
+		if !vars.ValidCodePattern.MatchString(code) {
 			log.Infow("deleting invalid data", "reason", "migration", "code", doc.ID, "dest", doc.URL)
 			_, err = r.conn.Collection(codeCollection).DeleteOne(ctx, bson.D{{"_id", doc.ID}})
 			if err != nil {
@@ -139,19 +698,308 @@ func (r *Repository) Migrate(ctx context.Context) error {
 			}
 		}
 	}
+
+	if defaultDomain == "" {
+		return nil
+	}
+	return r.migrateDomain(ctx, defaultDomain)
+}
+
+func (r *Repository) MigrationDone(ctx context.Context, name string) (bool, error) {
+	count, err := r.conn.Collection(migrationCollection).CountDocuments(ctx, bson.D{{"_id", name}})
+	return count != 0, err
+}
+
+func (r *Repository) SetMigrationDone(ctx context.Context, name string) error {
+	_, err := r.conn.Collection(migrationCollection).ReplaceOne(ctx, bson.D{{"_id", name}}, Migration{
+		Name:        name,
+		CompletedAt: time.Now().UTC(),
+	}, options.Replace().SetUpsert(true))
+	return err
+}
+
+// migrateDomain moves shortlinks, trashed shortlinks, aliases and revisions without a domain to the default domain. The key is
+// part of the _id, so the documents have to be replaced.
+func (r *Repository) migrateDomain(ctx context.Context, defaultDomain string) error {
+	withoutDomain := bson.D{{"domain", bson.D{{"$exists", false}}}}
+
+	for _, collection := range []string{codeCollection, trashCollection, aliasCollection} {
+		cur, err := r.conn.Collection(collection).Find(ctx, withoutDomain)
+		if err != nil {
+			return err
+		}
+
+		var docs []bson.M
+		err = cur.All(ctx, &docs)
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			oldID, ok := doc["_id"].(string)
+			if !ok {
+				continue
+			}
+
+			log.Infow("moving entry to default domain", "reason", "migration", "collection", collection, "code", oldID, "domain", defaultDomain)
+			doc["_id"] = persistence.Key(defaultDomain, oldID)
+			doc["domain"] = defaultDomain
+			_, err = r.conn.Collection(collection).InsertOne(ctx, doc)
+			// A previous migration might have been interrupted after the insert
+			if err != nil && !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+
+			_, err = r.conn.Collection(collection).DeleteOne(ctx, bson.D{{"_id", oldID}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cur, err := r.conn.Collection(revisionCollection).Find(ctx, bson.D{{"shortlink.domain", bson.D{{"$exists", false}}}})
+	if err != nil {
+		return err
+	}
+
+	var revisions []Revision
+	err = cur.All(ctx, &revisions)
+	if err != nil {
+		return err
+	}
+
+	for _, revision := range revisions {
+		key := persistence.Key(defaultDomain, revision.Code)
+		_, err = r.conn.Collection(revisionCollection).UpdateOne(ctx, bson.D{{"_id", revision.ID}}, bson.D{{
+			"$set", bson.D{
+				{"code", key},
+				{"shortlink._id", key},
+				{"shortlink.domain", defaultDomain},
+			},
+		}})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// filterQuery matches the code part of the key, the domain is optional because it is only part of the key if domains
+// are configured
+func filterQuery(filter persistence.Filter) bson.D {
+	var conditions bson.A
+	if filter.Prefix != "" {
+		conditions = append(conditions, bson.D{{"_id", bson.D{{"$regex", codePrefixPattern(filter.Prefix)}}}})
+	}
+
+	if filter.Namespaces != nil {
+		namespaces := bson.A{}
+		for _, prefix := range filter.Namespaces {
+			namespaces = append(namespaces, bson.D{{"_id", bson.D{{"$regex", codePrefixPattern(prefix)}}}})
+		}
+		// An empty $or is invalid, a filter without namespaces doesn't match any shortlink
+		if len(namespaces) == 0 {
+			namespaces = append(namespaces, bson.D{{"_id", bson.D{{"$in", bson.A{}}}}})
+		}
+		conditions = append(conditions, bson.D{{"$or", namespaces}})
+	}
+
+	if filter.Domain != "" {
+		conditions = append(conditions, bson.D{{"domain", filter.Domain}})
+	}
+
+	if filter.Campaign != "" {
+		conditions = append(conditions, bson.D{{"campaign.name", filter.Campaign}})
+	}
+
+	if filter.Search != "" {
+		search := bson.D{{"$regex", regexp.QuoteMeta(filter.Search)}, {"$options", "i"}}
+		conditions = append(conditions, bson.D{{"$or", bson.A{
+			// The code is the part of the key after the domain separator
+			bson.D{{"_id", bson.D{{"$regex", regexp.QuoteMeta(filter.Search) + `[^|]*$`}, {"$options", "i"}}}},
+			bson.D{{"url", search}},
+			bson.D{{"title", search}},
+		}}})
+	}
+
+	if len(conditions) == 0 {
+		return bson.D{}
+	}
+	return bson.D{{"$and", conditions}}
+}
+
+func codePrefixPattern(prefix string) string {
+	return `^([^|]*\|)?` + regexp.QuoteMeta(prefix)
+}
+
 func mapToGeneric(in []Shortlink) []persistence.Shortlink {
 	out := make([]persistence.Shortlink, 0, len(in))
 	for _, s := range in {
-		out = append(out, persistence.Shortlink{
-			Code: s.ID,
+		out = append(out, toGeneric(s))
+	}
+	return out
+}
+
+func toGeneric(in Shortlink) persistence.Shortlink {
+	var schedule []persistence.ScheduledDestination
+	for _, s := range in.Schedule {
+		schedule = append(schedule, persistence.ScheduledDestination{
+			From: s.From,
 			URL:  s.URL,
-			TTL:  s.TTL,
 		})
 	}
-	return out
+
+	var rules []persistence.Rule
+	for _, r := range in.Rules {
+		rules = append(rules, persistence.Rule(r))
+	}
+
+	var variants []persistence.Variant
+	for _, v := range in.Variants {
+		variants = append(variants, persistence.Variant(v))
+	}
+
+	domain, code := persistence.SplitKey(in.ID)
+	return persistence.Shortlink{
+		Domain:         domain,
+		Code:           code,
+		URL:            in.URL,
+		TTL:            in.TTL,
+		ActiveFrom:     in.ActiveFrom,
+		Schedule:       schedule,
+		Rules:          rules,
+		Variants:       variants,
+		StickyVariants: in.StickyVariants,
+		Campaign:       campaignToGeneric(in.Campaign),
+		RedirectStatus: in.RedirectStatus,
+		Passthrough:    in.Passthrough,
+		Template:       in.Template,
+		Title:          in.Title,
+		Interstitial:   in.Interstitial,
+		Warning:        in.Warning,
+		PasswordHash:   in.PasswordHash,
+		Internal:       in.Internal,
+		Health:         healthToGeneric(in.Health),
+	}
+}
+
+func fromGeneric(in persistence.Shortlink) Shortlink {
+	var schedule []ScheduledDestination
+	for _, s := range in.Schedule {
+		schedule = append(schedule, ScheduledDestination{
+			From: s.From,
+			URL:  s.URL,
+		})
+	}
+
+	var rules []Rule
+	for _, r := range in.Rules {
+		rules = append(rules, Rule(r))
+	}
+
+	var variants []Variant
+	for _, v := range in.Variants {
+		variants = append(variants, Variant(v))
+	}
+
+	return Shortlink{
+		ID:             persistence.Key(in.Domain, in.Code),
+		Domain:         in.Domain,
+		URL:            in.URL,
+		TTL:            in.TTL,
+		ActiveFrom:     in.ActiveFrom,
+		Schedule:       schedule,
+		Rules:          rules,
+		Variants:       variants,
+		StickyVariants: in.StickyVariants,
+		Campaign:       campaignFromGeneric(in.Campaign),
+		RedirectStatus: in.RedirectStatus,
+		Passthrough:    in.Passthrough,
+		Template:       in.Template,
+		Title:          in.Title,
+		Interstitial:   in.Interstitial,
+		Warning:        in.Warning,
+		PasswordHash:   in.PasswordHash,
+		Internal:       in.Internal,
+		Health:         healthFromGeneric(in.Health),
+	}
+}
+
+func campaignFromGeneric(in persistence.Campaign) *Campaign {
+	if in == (persistence.Campaign{}) {
+		return nil
+	}
+	c := Campaign(in)
+	return &c
+}
+
+func campaignToGeneric(in *Campaign) persistence.Campaign {
+	if in == nil {
+		return persistence.Campaign{}
+	}
+	return persistence.Campaign(*in)
+}
+
+func healthFromGeneric(in persistence.Health) *Health {
+	if in.CheckedAt.IsZero() {
+		return nil
+	}
+	return &Health{
+		CheckedAt:           in.CheckedAt,
+		StatusCode:          in.StatusCode,
+		Latency:             in.Latency,
+		Error:               in.Error,
+		ConsecutiveFailures: in.ConsecutiveFailures,
+	}
+}
+
+func healthToGeneric(in *Health) persistence.Health {
+	if in == nil {
+		return persistence.Health{}
+	}
+	return persistence.Health{
+		CheckedAt:           in.CheckedAt,
+		StatusCode:          in.StatusCode,
+		Latency:             in.Latency,
+		Error:               in.Error,
+		ConsecutiveFailures: in.ConsecutiveFailures,
+	}
+}
+
+func aliasToGeneric(alias Alias) persistence.Alias {
+	domain, code := persistence.SplitKey(alias.ID)
+	return persistence.Alias{
+		Domain: domain,
+		Code:   code,
+		Target: alias.Target,
+	}
+}
+
+// trashDocumentID appends the trash ID to the key, shortlinks trashed before IDs existed use the key alone
+func trashDocumentID(key, id string) string {
+	if id == "" {
+		return key
+	}
+	return key + trashIDSeparator + id
+}
+
+func trashedToGeneric(trashed TrashedShortlink) persistence.TrashedShortlink {
+	shortlink := trashed.Shortlink
+	shortlink.ID = strings.TrimSuffix(shortlink.ID, trashIDSeparator+trashed.TrashID)
+	return persistence.TrashedShortlink{
+		Shortlink: toGeneric(shortlink),
+		ID:        trashed.TrashID,
+		DeletedAt: trashed.DeletedAt,
+	}
+}
+
+func revisionToGeneric(revision Revision) persistence.Revision {
+	return persistence.Revision{
+		Shortlink: toGeneric(revision.Shortlink),
+		ID:        revision.ID,
+		Editor:    revision.Editor,
+		CreatedAt: revision.CreatedAt,
+	}
 }
 
 func (r *Repository) Close() error {
@@ -0,0 +1,108 @@
+package persistence
+
+import (
+	"context"
+	"github.com/patrick246/shortlink/pkg/observability/logging"
+	"sort"
+)
+
+var normalizationLog = logging.CreateLogger("code-normalization")
+
+// storedCode is a code used by a shortlink or an alias, both share the codes of a domain
+type storedCode struct {
+	domain string
+	code   string
+	alias  bool
+}
+
+// NormalizeCodes renames stored shortlinks and aliases whose code isn't normalized yet, so they can still be found after
+// the normalization has been enabled. Revisions move with their shortlink and aliases keep their target. Codes
+// colliding with other codes after normalization are reported and kept unchanged, they have to be resolved manually.
+// The pass runs once for each policy, codes saved later are normalized when they are saved.
+func NormalizeCodes(ctx context.Context, repo Repository, policy string, normalize func(code string) string) error {
+	migration := "code-normalization/" + policy
+	done, err := repo.MigrationDone(ctx, migration)
+	if err != nil || done {
+		return err
+	}
+
+	shortlinks, err := AllEntries(ctx, repo)
+	if err != nil {
+		return err
+	}
+	aliases, err := repo.GetAllAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]storedCode)
+	for _, shortlink := range shortlinks {
+		key := Key(shortlink.Domain, normalize(shortlink.Code))
+		groups[key] = append(groups[key], storedCode{domain: shortlink.Domain, code: shortlink.Code})
+	}
+	for _, alias := range aliases {
+		key := Key(alias.Domain, normalize(alias.Code))
+		groups[key] = append(groups[key], storedCode{domain: alias.Domain, code: alias.Code, alias: true})
+	}
+
+	// Aliases are renamed after the shortlinks, so they are saved with the new code of their target
+	var renamedAliases []storedCode
+	for key, group := range groups {
+		domain, normalized := SplitKey(key)
+		if len(group) > 1 {
+			var codes []string
+			for _, stored := range group {
+				codes = append(codes, stored.code)
+			}
+			sort.Strings(codes)
+			normalizationLog.Warnw("codes collide after normalization, only exact matches are found", "domain", domain, "normalized", normalized, "codes", codes)
+			continue
+		}
+
+		stored := group[0]
+		if stored.code == normalized {
+			continue
+		}
+		if normalized == "" {
+			normalizationLog.Warnw("code is empty after normalization, only exact matches are found", "domain", domain, "code", stored.code)
+			continue
+		}
+		if stored.alias {
+			renamedAliases = append(renamedAliases, stored)
+			continue
+		}
+
+		normalizationLog.Infow("renaming code", "reason", "migration", "domain", domain, "code", stored.code, "normalized", normalized)
+		err = repo.RenameCode(ctx, domain, stored.code, domain, normalized)
+		if err == ErrConflict {
+			normalizationLog.Warnw("normalized code is already used, only exact matches are found", "domain", domain, "code", stored.code, "normalized", normalized)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, stored := range renamedAliases {
+		alias, err := repo.GetAlias(ctx, stored.domain, stored.code)
+		if err != nil {
+			return err
+		}
+
+		normalized := normalize(stored.code)
+		normalizationLog.Infow("renaming alias", "reason", "migration", "domain", stored.domain, "code", stored.code, "normalized", normalized)
+		oldCode := alias.Code
+		alias.Code = normalized
+		err = repo.SetAlias(ctx, alias)
+		if err != nil {
+			return err
+		}
+
+		err = repo.DeleteAlias(ctx, stored.domain, oldCode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return repo.SetMigrationDone(ctx, migration)
+}
@@ -0,0 +1,129 @@
+package persistence_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/patrick246/shortlink/pkg/persistence/badger"
+)
+
+func newRepository(t *testing.T) persistence.Repository {
+	repo, err := badger.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = repo.Close()
+	})
+	return repo
+}
+
+func TestNormalizeCodes(t *testing.T) {
+	repo := newRepository(t)
+	ctx := context.Background()
+	for _, code := range []string{"Meet", "Docs", "docs", "Wiki", "wiki-old"} {
+		shortlink := persistence.Shortlink{Code: code, URL: "https://example.com/" + code}
+		err := repo.SetEntry(ctx, shortlink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.AddRevision(ctx, persistence.Revision{Shortlink: shortlink})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, alias := range []persistence.Alias{
+		{Code: "Chat", Target: "Meet"},
+		{Code: "WIKI-OLD", Target: "Wiki"},
+	} {
+		err := repo.SetAlias(ctx, alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := persistence.NormalizeCodes(ctx, repo, "case", strings.ToLower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code   string
+		exists bool
+	}{
+		{code: "meet", exists: true},
+		{code: "Meet", exists: false},
+		{code: "wiki", exists: true},
+		{code: "Wiki", exists: false},
+		// Colliding codes are kept unchanged
+		{code: "Docs", exists: true},
+		{code: "docs", exists: true},
+		{code: "wiki-old", exists: true},
+	}
+	for _, test := range tests {
+		_, err := repo.GetEntryForCode(ctx, "", test.code)
+		if test.exists && err != nil {
+			t.Errorf("expected shortlink %s, got %v", test.code, err)
+		}
+		if !test.exists && err != persistence.ErrNotFound {
+			t.Errorf("expected shortlink %s to be renamed, got %v", test.code, err)
+		}
+	}
+
+	revisions, err := repo.GetRevisions(ctx, "", "meet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("expected the revision to move with the shortlink, got %d", len(revisions))
+	}
+
+	aliases := []struct {
+		code   string
+		target string
+	}{
+		{code: "chat", target: "meet"},
+		// The alias collides with the shortlink wiki-old and keeps its code, but follows its renamed target
+		{code: "WIKI-OLD", target: "wiki"},
+	}
+	for _, expected := range aliases {
+		alias, err := repo.GetAlias(ctx, "", expected.code)
+		if err != nil || alias.Target != expected.target {
+			t.Errorf("expected alias %s to %s, got %+v, %v", expected.code, expected.target, alias, err)
+		}
+	}
+	if _, err := repo.GetAlias(ctx, "", "Chat"); err != persistence.ErrNotFound {
+		t.Errorf("expected alias Chat to be renamed, got %v", err)
+	}
+}
+
+func TestNormalizeCodesRunsOncePerPolicy(t *testing.T) {
+	repo := newRepository(t)
+	ctx := context.Background()
+	err := persistence.NormalizeCodes(ctx, repo, "case", strings.ToLower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.SetEntry(ctx, persistence.Shortlink{Code: "Meet", URL: "https://example.com/meet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = persistence.NormalizeCodes(ctx, repo, "case", strings.ToLower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetEntryForCode(ctx, "", "Meet"); err != nil {
+		t.Errorf("expected the pass not to run again, got %v", err)
+	}
+
+	err = persistence.NormalizeCodes(ctx, repo, "case,punctuation", strings.ToLower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetEntryForCode(ctx, "", "meet"); err != nil {
+		t.Errorf("expected the pass to run for a new policy, got %v", err)
+	}
+}
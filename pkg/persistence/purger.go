@@ -0,0 +1,30 @@
+package persistence
+
+import (
+	"context"
+	"github.com/patrick246/shortlink/pkg/observability/logging"
+	"time"
+)
+
+var log = logging.CreateLogger("trash-purger")
+
+// RunTrashPurger removes trashed shortlinks once they are older than retention. It blocks until ctx is cancelled.
+func RunTrashPurger(ctx context.Context, repo Repository, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := repo.PurgeTrash(ctx, time.Now().Add(-retention))
+		if err != nil {
+			log.Errorw("error purging trash", "retention", retention, "error", err)
+		} else if purged > 0 {
+			log.Infow("purged trash", "count", purged, "retention", retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// keySeparator is neither valid in codes nor in domain names
+const keySeparator = "|"
+
+// Key identifies a shortlink across all domains. Shortlinks without a domain keep their code as key.
+func Key(domain, code string) string {
+	if domain == "" {
+		return code
+	}
+	return domain + keySeparator + code
+}
+
+func SplitKey(key string) (domain, code string) {
+	parts := strings.SplitN(key, keySeparator, 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+// IsActive reports whether the shortlink has gone live and hasn't expired at the given time
+func (s Shortlink) IsActive(now time.Time) bool {
+	if !s.ActiveFrom.IsZero() && now.Before(s.ActiveFrom) {
+		return false
+	}
+	if !s.TTL.IsZero() && s.TTL.Before(now) {
+		return false
+	}
+	return true
+}
+
+// KeyOnly reports whether Matches only needs the domain and the code of the shortlinks
+func (f Filter) KeyOnly() bool {
+	return f.Search == "" && f.Campaign == ""
+}
+
+// Matches reports whether the shortlink is included in the filtered list, see KeyOnly for the fields that are needed
+func (f Filter) Matches(shortlink Shortlink) bool {
+	if !strings.HasPrefix(shortlink.Code, f.Prefix) {
+		return false
+	}
+	if f.Domain != "" && shortlink.Domain != f.Domain {
+		return false
+	}
+	if f.Search != "" && !containsFold(f.Search, shortlink.Code, shortlink.URL, shortlink.Title) {
+		return false
+	}
+	if f.Campaign != "" && shortlink.Campaign.Name != f.Campaign {
+		return false
+	}
+	if f.Namespaces == nil {
+		return true
+	}
+
+	for _, prefix := range f.Namespaces {
+		if strings.HasPrefix(shortlink.Code, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(search string, values ...string) bool {
+	search = strings.ToLower(search)
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// Broken reports whether the last check of the destination failed
+func (h Health) Broken() bool {
+	return h.Error != "" || h.StatusCode >= 400
+}
+
+// Destination returns the URL of the latest scheduled destination that has started, or URL if there is none
+func (s Shortlink) Destination(now time.Time) string {
+	destination := s.URL
+	var latest time.Time
+	for _, scheduled := range s.Schedule {
+		if scheduled.From.After(now) || scheduled.From.Before(latest) {
+			continue
+		}
+		destination = scheduled.URL
+		latest = scheduled.From
+	}
+	return destination
+}
+
+// SameDestinations reports whether both shortlinks send requests to the same destinations under the same conditions
+func (s Shortlink) SameDestinations(other Shortlink) bool {
+	if s.URL != other.URL || len(s.Schedule) != len(other.Schedule) || len(s.Rules) != len(other.Rules) || len(s.Variants) != len(other.Variants) {
+		return false
+	}
+	for i, scheduled := range s.Schedule {
+		if !scheduled.From.Equal(other.Schedule[i].From) || scheduled.URL != other.Schedule[i].URL {
+			return false
+		}
+	}
+	for i, rule := range s.Rules {
+		if rule != other.Rules[i] {
+			return false
+		}
+	}
+	for i, variant := range s.Variants {
+		if variant != other.Variants[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AllEntries pages through all shortlinks of the repository
+func AllEntries(ctx context.Context, repo Repository) ([]Shortlink, error) {
+	const pageSize = 100
+
+	var all []Shortlink
+	for page := int64(0); ; page++ {
+		shortlinks, total, err := repo.GetEntries(ctx, Filter{}, page, pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("listing shortlinks: %w", err)
+		}
+		all = append(all, shortlinks...)
+		if len(shortlinks) == 0 || int64(len(all)) >= total {
+			return all, nil
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package persistence
+
+import (
+	"context"
+	"github.com/patrick246/shortlink/pkg/observability/logging"
+)
+
+var unreachableLog = logging.CreateLogger("unreachable-codes")
+
+// WarnUnreachableCodes logs the stored shortlinks and aliases whose code can't be requested anymore, e.g. because a
+// later version reserved it for its own routes. invalid describes why a code can't be used and is empty for valid codes.
+// The codes are kept, so they can be renamed in the admin area.
+func WarnUnreachableCodes(ctx context.Context, repo Repository, invalid func(code string) string) error {
+	shortlinks, err := AllEntries(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for _, shortlink := range shortlinks {
+		if reason := invalid(shortlink.Code); reason != "" {
+			unreachableLog.Warnw("shortlink can't be reached, rename it", "domain", shortlink.Domain, "code", shortlink.Code, "reason", reason)
+		}
+	}
+
+	aliases, err := repo.GetAllAliases(ctx)
+	if err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if reason := invalid(alias.Code); reason != "" {
+			unreachableLog.Warnw("alias can't be reached, remove it", "domain", alias.Domain, "code", alias.Code, "target", alias.Target, "reason", reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets are only removed once they are full again, sweep them before the map grows too large
+const maxTrackedClients = 10000
+
+var throttledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "shortlink_throttled_requests_total",
+	Help: "Number of requests rejected by a rate limit",
+}, []string{"policy"})
+
+func init() {
+	prometheus.MustRegister(throttledCounter)
+}
+
+// Policy allows Rate requests per second on average and bursts of up to Burst requests. A zero Rate disables the limit.
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+var units = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// ParsePolicy parses policies in the format <count>/<s|m|h>[:<burst>], e.g. 30/m:10. The burst defaults to the count,
+// "off" disables the limit.
+func ParsePolicy(value string) (Policy, error) {
+	if value == "off" {
+		return Policy{}, nil
+	}
+
+	rateValue, burstValue := value, ""
+	if i := strings.Index(value, ":"); i != -1 {
+		rateValue, burstValue = value[:i], value[i+1:]
+	}
+
+	parts := strings.Split(rateValue, "/")
+	if len(parts) != 2 {
+		return Policy{}, fmt.Errorf("expected <count>/<unit>, got %q", rateValue)
+	}
+
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count < 1 {
+		return Policy{}, fmt.Errorf("invalid count %q", parts[0])
+	}
+
+	unit, ok := units[parts[1]]
+	if !ok {
+		return Policy{}, fmt.Errorf("invalid unit %q, possible values: s, m, h", parts[1])
+	}
+
+	burst := count
+	if burstValue != "" {
+		burst, err = strconv.Atoi(burstValue)
+		if err != nil || burst < 1 {
+			return Policy{}, fmt.Errorf("invalid burst %q", burstValue)
+		}
+	}
+
+	return Policy{
+		Rate:  float64(count) / unit.Seconds(),
+		Burst: burst,
+	}, nil
+}
+
+// Limiter keeps a token bucket per client
+type Limiter struct {
+	name    string
+	policy  Policy
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter, name is used as the policy label of the throttled requests metric
+func New(name string, policy Policy) *Limiter {
+	return &Limiter{
+		name:    name,
+		policy:  policy,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token for the client. It returns how long the client has to wait if there is none left, zero otherwise.
+func (l *Limiter) Allow(key string, now time.Time) time.Duration {
+	if l.policy.Rate == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		return l.throttled(b)
+	}
+	b.tokens--
+	return 0
+}
+
+// Check returns how long the client has to wait for the next token without taking it, zero if there is one left.
+// Use Consume to take tokens afterwards, e.g. only for failed requests.
+func (l *Limiter) Check(key string, now time.Time) time.Duration {
+	if l.policy.Rate == 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		return l.throttled(b)
+	}
+	return 0
+}
+
+func (l *Limiter) Consume(key string, now time.Time) {
+	if l.policy.Rate == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, now)
+	b.tokens = math.Max(0, b.tokens-1)
+}
+
+func (l *Limiter) throttled(b *bucket) time.Duration {
+	throttledCounter.WithLabelValues(l.name).Inc()
+	return time.Duration((1 - b.tokens) / l.policy.Rate * float64(time.Second))
+}
+
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxTrackedClients {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: float64(l.policy.Burst), last: now}
+		l.buckets[key] = b
+		return b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(l.policy.Burst), b.tokens+elapsed*l.policy.Rate)
+		b.last = now
+	}
+	return b
+}
+
+// sweep removes the buckets of clients that would be full again, they behave like new clients
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.policy.Rate >= float64(l.policy.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RetryAfter formats a wait duration for the Retry-After header, rounded up to full seconds
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		policy  Policy
+		invalid bool
+	}{
+		{value: "off", policy: Policy{}},
+		{value: "10/s", policy: Policy{Rate: 10, Burst: 10}},
+		{value: "30/m:10", policy: Policy{Rate: 0.5, Burst: 10}},
+		{value: "3600/h:1", policy: Policy{Rate: 1, Burst: 1}},
+		{value: "", invalid: true},
+		{value: "10", invalid: true},
+		{value: "10/d", invalid: true},
+		{value: "0/s", invalid: true},
+		{value: "-1/s", invalid: true},
+		{value: "ten/s", invalid: true},
+		{value: "10/s:0", invalid: true},
+		{value: "10/s/m", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			policy, err := ParsePolicy(test.value)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy != test.policy {
+				t.Errorf("expected %+v, got %+v", test.policy, policy)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	tests := []struct {
+		name   string
+		policy Policy
+		offset []time.Duration
+		wait   []time.Duration
+	}{
+		{
+			name:   "disabled",
+			policy: Policy{},
+			offset: []time.Duration{0, 0, 0},
+			wait:   []time.Duration{0, 0, 0},
+		},
+		{
+			name:   "burst",
+			policy: Policy{Rate: 1, Burst: 2},
+			offset: []time.Duration{0, 0, 0},
+			wait:   []time.Duration{0, 0, time.Second},
+		},
+		{
+			name:   "refill",
+			policy: Policy{Rate: 1, Burst: 1},
+			offset: []time.Duration{0, 0, 500 * time.Millisecond, time.Second},
+			wait:   []time.Duration{0, time.Second, 500 * time.Millisecond, 0},
+		},
+		{
+			name:   "refill is capped at the burst",
+			policy: Policy{Rate: 1, Burst: 1},
+			offset: []time.Duration{0, time.Hour, time.Hour},
+			wait:   []time.Duration{0, 0, time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := New("test", test.policy)
+			for i, offset := range test.offset {
+				wait := limiter.Allow("client", start.Add(offset))
+				if wait != test.wait[i] {
+					t.Errorf("request %d: expected a wait of %s, got %s", i, test.wait[i], wait)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowKeepsClientsApart(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	limiter := New("test", Policy{Rate: 1, Burst: 1})
+	if wait := limiter.Allow("first", now); wait != 0 {
+		t.Fatalf("expected no wait, got %s", wait)
+	}
+	if wait := limiter.Allow("first", now); wait == 0 {
+		t.Errorf("expected the first client to wait")
+	}
+	if wait := limiter.Allow("second", now); wait != 0 {
+		t.Errorf("expected no wait for the second client, got %s", wait)
+	}
+}
+
+func TestCheckOnlyCountsConsumedRequests(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	limiter := New("test", Policy{Rate: 1, Burst: 2})
+	for i := 0; i < 5; i++ {
+		if wait := limiter.Check("client", now); wait != 0 {
+			t.Fatalf("expected checks not to take tokens, got a wait of %s", wait)
+		}
+	}
+
+	limiter.Consume("client", now)
+	limiter.Consume("client", now)
+	limiter.Consume("client", now)
+	if wait := limiter.Check("client", now); wait != time.Second {
+		t.Errorf("expected a wait of 1s after consuming the burst, got %s", wait)
+	}
+	if wait := limiter.Check("client", now.Add(time.Second)); wait != 0 {
+		t.Errorf("expected a token after 1s, got a wait of %s", wait)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait     time.Duration
+		expected string
+	}{
+		{wait: 0, expected: "0"},
+		{wait: time.Millisecond, expected: "1"},
+		{wait: time.Second, expected: "1"},
+		{wait: 1500 * time.Millisecond, expected: "2"},
+		{wait: time.Minute, expected: "60"},
+	}
+
+	for _, test := range tests {
+		if retryAfter := RetryAfter(test.wait); retryAfter != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.wait, test.expected, retryAfter)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
@@ -8,7 +9,9 @@ import (
 	"github.com/patrick246/shortlink/pkg/persistence"
 	"github.com/patrick246/shortlink/pkg/vars"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,20 +29,52 @@ func (s *Server) listShortlinks(writer http.ResponseWriter, request *http.Reques
 
 	size := int64(5)
 
-	shortlinks, total, err := s.repo.GetEntries(request.Context(), page, size)
+	userAccess, err := s.userAccess(request.Context())
 	if err != nil {
+		log.Errorw("get namespaces error", "error", err)
 		http.Error(writer, "Error getting shortlinks", 500)
 		return
 	}
 
+	filter := persistence.Filter{
+		Prefix:     request.URL.Query().Get("prefix"),
+		Namespaces: userAccess.namespaces(),
+		Campaign:   request.URL.Query().Get("campaign"),
+	}
+
+	shortlinks, total, err := s.repo.GetEntries(request.Context(), filter, page, size)
+	if err != nil {
+		http.Error(writer, "Error getting shortlinks", 500)
+		return
+	}
+
+	aliases, err := s.aliasesByKey(request.Context(), shortlinks)
+	if err != nil {
+		log.Errorw("get aliases error", "error", err)
+		http.Error(writer, "Error getting shortlinks", 500)
+		return
+	}
+
+	newDomain := s.defaultDomain()
+	if domain := request.URL.Query().Get("domain"); domain != "" && s.validDomain(domain) {
+		newDomain = domain
+	}
+
 	csrfToken := generateCsrf(writer, request)
 
 	err = templates["list.page.gohtml"].Execute(writer, listTemplateData{
-		Shortlinks: shortlinks,
-		Page:       page,
-		Total:      total,
-		Size:       size,
-		CSRF:       csrfToken,
+		Shortlinks:            shortlinks,
+		Aliases:               aliases,
+		Prefix:                filter.Prefix,
+		Campaign:              filter.Campaign,
+		NewCode:               request.URL.Query().Get("code"),
+		Page:                  page,
+		Total:                 total,
+		Size:                  size,
+		CSRF:                  csrfToken,
+		DefaultRedirectStatus: s.options.DefaultRedirectStatus,
+		Domains:               s.options.Domains,
+		DefaultDomain:         newDomain,
 	})
 	if err != nil {
 		log.Errorw("error rendering page", "url", request.URL.String(), "error", err)
@@ -47,54 +82,76 @@ func (s *Server) listShortlinks(writer http.ResponseWriter, request *http.Reques
 	}
 }
 
-func (s *Server) editShortlink(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	code := params.ByName("code")
+func (s *Server) editShortlink(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	domain := request.URL.Query().Get("domain")
+	code := request.URL.Query().Get("code")
+	if !s.checkAccess(writer, request, code) {
+		return
+	}
 
-	entry, err := s.repo.GetEntryForCode(request.Context(), code)
+	entry, err := s.repo.GetEntryForCode(request.Context(), domain, code)
 	if err != nil {
 		http.Error(writer, "Error getting database data", 500)
 		return
 	}
 
-	csrfToken := generateCsrf(writer, request)
+	revisions, err := s.repo.GetRevisions(request.Context(), domain, code)
+	if err != nil {
+		log.Errorw("get revisions error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
 
-	err = templates["edit.page.gohtml"].Execute(writer, editTemplateData{
-		Code: code,
-		URL:  entry.URL,
-		CSRF: csrfToken,
-		TTL:  entry.TTL,
-	})
+	aliases, err := s.repo.GetAliases(request.Context(), domain, code)
+	if err != nil {
+		log.Errorw("get aliases error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+
+	data := s.editTemplateData(entry, generateCsrf(writer, request))
+	data.ExistingDomain = domain
+	data.ExistingCode = code
+	data.Revisions = revisions
+	data.Aliases = aliases
+
+	err = templates["edit.page.gohtml"].Execute(writer, data)
 	if err != nil {
 		log.Errorw("error rendering page", "url", request.URL.String(), "error", err)
 		http.Error(writer, "Error rendering page", 500)
 	}
 }
 
-func (s *Server) createOrEdit(writer http.ResponseWriter, request *http.Request, param httprouter.Params) {
+func (s *Server) createOrEdit(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
 	err := checkCsrf(request)
 	if err != nil {
 		http.Error(writer, "csrf token error", 403)
 		return
 	}
 
-	formCode := request.Form.Get("code")
+	// The code of an existing shortlink is passed in the query, only the submitted code is used here
+	formCode := s.options.CodeNormalization.Normalize(request.PostForm.Get("code"))
 	if formCode == "" {
 		http.Error(writer, "Missing code in form data", 400)
 		return
 	}
 
-	if !vars.ValidCodePattern.MatchString(formCode) {
-		allowedCharacters := vars.ValidCodePattern.String()[2 : len(vars.ValidCodePattern.String())-3]
-		http.Error(writer, "Code contains invalid characters. Allowed characters are "+allowedCharacters, 400)
+	if reason := InvalidCode(formCode); reason != "" {
+		http.Error(writer, "Invalid code. "+reason, 400)
 		return
 	}
 
-	formUrl := request.Form.Get("url")
-	if formUrl == "" {
-		http.Error(writer, "Missing url in form data", 400)
+	formDomain := request.PostForm.Get("domain")
+	if formDomain == "" {
+		formDomain = s.defaultDomain()
+	}
+	if !s.validDomain(formDomain) {
+		http.Error(writer, "Unknown domain in form data", 400)
 		return
 	}
 
+	formUrl := request.Form.Get("url")
+
 	formTtlDate := request.Form.Get("ttl-date")
 	if formTtlDate == "" {
 		http.Error(writer, "Missing TTL date part in form data", 400)
@@ -112,33 +169,126 @@ func (s *Server) createOrEdit(writer http.ResponseWriter, request *http.Request,
 		formTtlTz = "Z"
 	}
 
-	var formTtl time.Time
-	if formTtlDate != "0001-01-01" || formTtlTime != "00:00:00" {
-		formTtl, err = time.Parse("2006-01-02T15:04:05Z07:00", fmt.Sprintf("%sT%s%s", formTtlDate, formTtlTime, formTtlTz))
-		if err != nil {
-			http.Error(writer, fmt.Sprintf("Error parsing date in form: %v", err), 400)
+	formTtl, err := parseFormTime(formTtlDate, formTtlTime, formTtlTz)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error parsing date in form: %v", err), 400)
+		return
+	}
+
+	formActiveFrom, err := parseFormTime(request.Form.Get("active-from-date"), request.Form.Get("active-from-time"), formTtlTz)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error parsing activation date in form: %v", err), 400)
+		return
+	}
+
+	formSchedule, err := parseFormSchedule(request, formTtlTz)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error parsing scheduled destinations in form: %v", err), 400)
+		return
+	}
+
+	formRules, err := parseFormRules(request)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error parsing rules in form: %v", err), 400)
+		return
+	}
+
+	formVariants, err := parseFormVariants(request)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error parsing variants in form: %v", err), 400)
+		return
+	}
+
+	var formRedirectStatus int
+	if formStatus := request.Form.Get("redirect-status"); formStatus != "" {
+		formRedirectStatus, err = strconv.Atoi(formStatus)
+		if err != nil || !ValidRedirectStatus(formRedirectStatus) {
+			http.Error(writer, "Invalid redirect status in form data", 400)
 			return
 		}
 	}
 
-	existingCode := param.ByName("code")
+	existingDomain := request.URL.Query().Get("domain")
+	existingCode := request.URL.Query().Get("code")
+	if existingCode != "" && !s.checkAccess(writer, request, existingCode) {
+		return
+	}
+
+	shortlink := persistence.Shortlink{
+		Domain:         formDomain,
+		Code:           formCode,
+		URL:            formUrl,
+		TTL:            formTtl,
+		ActiveFrom:     formActiveFrom,
+		Schedule:       formSchedule,
+		Rules:          formRules,
+		Variants:       formVariants,
+		StickyVariants: request.Form.Get("sticky-variants") == "on",
+		Campaign: persistence.Campaign{
+			Source:  strings.TrimSpace(request.Form.Get("utm-source")),
+			Medium:  strings.TrimSpace(request.Form.Get("utm-medium")),
+			Name:    strings.TrimSpace(request.Form.Get("utm-campaign")),
+			Term:    strings.TrimSpace(request.Form.Get("utm-term")),
+			Content: strings.TrimSpace(request.Form.Get("utm-content")),
+		},
+		RedirectStatus: formRedirectStatus,
+		Passthrough:    request.Form.Get("passthrough") == "on",
+		Template:       request.Form.Get("template") == "on",
+		Title:          request.Form.Get("title"),
+		Interstitial:   request.Form.Get("interstitial") == "on",
+		Warning:        request.Form.Get("warning"),
+		Internal:       request.Form.Get("internal") == "on",
+	}
+
+	shortlink.PasswordHash, err = s.formPasswordHash(request, existingDomain, existingCode)
+	if err != nil {
+		log.Errorw("password hash error", "code", formCode, "error", err)
+		http.Error(writer, "Could not set password", 500)
+		return
+	}
+
+	fieldErrors := s.validateDestinations(request, shortlink)
+	userAccess, err := s.userAccess(request.Context())
+	if err != nil {
+		log.Errorw("get namespaces error", "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+	if !userAccess.mayManage(formCode) {
+		fieldErrors["code"] = "The code has to start with the prefix of one of your namespaces"
+	}
+
+	_, err = s.repo.GetAlias(request.Context(), formDomain, formCode)
+	if err == nil {
+		fieldErrors["code"] = "The code is already used by an alias"
+	} else if err != persistence.ErrNotFound {
+		log.Errorw("get alias error", "domain", formDomain, "code", formCode, "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+	if len(fieldErrors) != 0 {
+		s.renderFieldErrors(writer, request, shortlink, existingDomain, existingCode, fieldErrors)
+		return
+	}
 
-	if existingCode != formCode && existingCode != "" {
-		err = s.repo.DeleteCode(request.Context(), existingCode)
+	// Renamed shortlinks keep their revisions and aliases, the changes are saved as a new revision afterwards
+	if (existingCode != formCode || existingDomain != formDomain) && existingCode != "" {
+		err = s.repo.RenameCode(request.Context(), existingDomain, existingCode, formDomain, formCode)
+		if err == persistence.ErrConflict {
+			fieldErrors["code"] = "The code is already used by another shortlink"
+			s.renderFieldErrors(writer, request, shortlink, existingDomain, existingCode, fieldErrors)
+			return
+		}
 		if err != nil {
-			log.Errorw("delete code error", "code", existingCode, "error", err)
-			http.Error(writer, "Could not remove old code", 500)
+			log.Errorw("rename code error", "domain", existingDomain, "code", existingCode, "newDomain", formDomain, "newCode", formCode, "error", err)
+			http.Error(writer, "Could not rename shortlink", 500)
 			return
 		}
 	}
 
-	err = s.repo.SetEntry(request.Context(), persistence.Shortlink{
-		Code: formCode,
-		URL:  formUrl,
-		TTL:  formTtl,
-	})
+	err = s.saveShortlink(request, shortlink)
 	if err != nil {
-		log.Errorw("set code error", "code", formCode, "url", formUrl, "error", err)
+		log.Errorw("set code error", "domain", formDomain, "code", formCode, "url", formUrl, "error", err)
 		http.Error(writer, "Could not save shortlink", 500)
 		return
 	}
@@ -147,16 +297,235 @@ func (s *Server) createOrEdit(writer http.ResponseWriter, request *http.Request,
 	return
 }
 
-func (s *Server) deleteShortlink(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+func (s *Server) rollbackShortlink(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	domain := request.URL.Query().Get("domain")
+	code := request.URL.Query().Get("code")
+	if !s.checkAccess(writer, request, code) {
+		return
+	}
+	revision, err := s.repo.GetRevision(request.Context(), domain, code, request.URL.Query().Get("revision"))
+	if err == persistence.ErrNotFound {
+		http.Error(writer, "revision not found", 404)
+		return
+	}
+	if err != nil {
+		log.Errorw("get revision error", "domain", domain, "code", code, "revision", request.URL.Query().Get("revision"), "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+
+	_, err = s.repo.GetAlias(request.Context(), domain, code)
+	if err == nil {
+		http.Error(writer, "code is already in use by an alias", 409)
+		return
+	}
+	if err != persistence.ErrNotFound {
+		log.Errorw("get alias error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "Could not save shortlink", 500)
+		return
+	}
+
+	// The URL policy might have changed since the revision was saved, it has to pass like a new edit
+	if fieldErrors := s.validateDestinations(request, revision.Shortlink); len(fieldErrors) != 0 {
+		s.renderFieldErrors(writer, request, revision.Shortlink, domain, code, fieldErrors)
+		return
+	}
+
+	err = s.saveShortlink(request, revision.Shortlink)
+	if err != nil {
+		log.Errorw("rollback code error", "domain", domain, "code", code, "revision", revision.ID, "error", err)
+		http.Error(writer, "Could not save shortlink", 500)
+		return
+	}
+
+	http.Redirect(writer, request, editPath(domain, code), 302)
+}
+
+// formPasswordHash hashes a newly entered password. Without a new password the existing one is kept unless its removal
+// was requested.
+func (s *Server) formPasswordHash(request *http.Request, existingDomain, existingCode string) (string, error) {
+	if request.Form.Get("remove-password") == "on" {
+		return "", nil
+	}
+
+	if password := request.Form.Get("password"); password != "" {
+		return HashPassword(password)
+	}
+
+	if existingCode == "" {
+		return "", nil
+	}
+
+	existing, err := s.repo.GetEntryForCode(request.Context(), existingDomain, existingCode)
+	if err == persistence.ErrNotFound {
+		return "", nil
+	}
+	return existing.PasswordHash, err
+}
+
+// validateDestinations checks all destinations of a shortlink against the URL policy, the result maps form fields
+// to error messages
+func (s *Server) validateDestinations(request *http.Request, shortlink persistence.Shortlink) map[string]string {
+	fieldErrors := make(map[string]string)
+	ownHosts := append([]string{request.Host}, s.options.Domains...)
+
+	err := s.validateDestination(shortlink, shortlink.URL, ownHosts)
+	if err != nil {
+		fieldErrors["url"] = err.Error()
+	}
+
+	for _, scheduled := range shortlink.Schedule {
+		err = s.validateDestination(shortlink, scheduled.URL, ownHosts)
+		if err != nil {
+			fieldErrors["schedule"] = fmt.Sprintf("%s: %v", scheduled.URL, err)
+			break
+		}
+	}
+
+	for _, rule := range shortlink.Rules {
+		err = validateRule(rule)
+		if err == nil {
+			err = s.validateDestination(shortlink, rule.URL, ownHosts)
+		}
+		if err != nil {
+			fieldErrors["rules"] = fmt.Sprintf("%s: %v", rule.URL, err)
+			break
+		}
+	}
+
+	err = validateVariants(shortlink.Variants)
+	if err == nil {
+		for _, variant := range shortlink.Variants {
+			err = s.validateDestination(shortlink, variant.URL, ownHosts)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", variant.URL, err)
+				break
+			}
+		}
+	}
+	if err != nil {
+		fieldErrors["variants"] = err.Error()
+	}
+
+	if message := validateCampaign(shortlink.Campaign); message != "" {
+		fieldErrors["campaign"] = message
+	}
+
+	if shortlink.Template && shortlink.Passthrough {
+		fieldErrors["template"] = "Templates use the path and query for the placeholders, they can't pass them through"
+	}
+	return fieldErrors
+}
+
+// validateDestination checks a destination against the URL policy, the placeholders of templates are filled with samples
+func (s *Server) validateDestination(shortlink persistence.Shortlink, destination string, ownHosts []string) error {
+	if shortlink.Template {
+		err := validateTemplate(destination)
+		if err != nil {
+			return err
+		}
+		destination = sampleDestination(destination)
+	}
+	return s.options.URLPolicy.ValidateURL(destination, ownHosts...)
+}
+
+// renderFieldErrors answers JSON clients with the errors per field, browsers get the form with the submitted values
+func (s *Server) renderFieldErrors(writer http.ResponseWriter, request *http.Request, shortlink persistence.Shortlink, existingDomain, existingCode string, fieldErrors map[string]string) {
+	if strings.Contains(request.Header.Get("Accept"), "application/json") {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusBadRequest)
+		err := json.NewEncoder(writer).Encode(map[string]interface{}{
+			"errors": fieldErrors,
+		})
+		if err != nil {
+			log.Errorw("error encoding response", "url", request.URL.String(), "error", err)
+		}
+		return
+	}
+
+	data := s.editTemplateData(shortlink, generateCsrf(writer, request))
+	data.ExistingDomain = existingDomain
+	data.ExistingCode = existingCode
+	data.Errors = fieldErrors
+
+	writer.WriteHeader(http.StatusBadRequest)
+	err := templates["edit.page.gohtml"].Execute(writer, data)
+	if err != nil {
+		log.Errorw("error rendering page", "url", request.URL.String(), "error", err)
+	}
+}
+
+func (s *Server) editTemplateData(shortlink persistence.Shortlink, csrfToken string) editTemplateData {
+	return editTemplateData{
+		Domain:                shortlink.Domain,
+		Domains:               s.options.Domains,
+		Code:                  shortlink.Code,
+		URL:                   shortlink.URL,
+		CSRF:                  csrfToken,
+		TTL:                   shortlink.TTL,
+		ActiveFrom:            shortlink.ActiveFrom,
+		Schedule:              shortlink.Schedule,
+		Rules:                 shortlink.Rules,
+		Variants:              shortlink.Variants,
+		StickyVariants:        shortlink.StickyVariants,
+		Campaign:              shortlink.Campaign,
+		RedirectStatus:        shortlink.RedirectStatus,
+		DefaultRedirectStatus: s.options.DefaultRedirectStatus,
+		Passthrough:           shortlink.Passthrough,
+		Template:              shortlink.Template,
+		Title:                 shortlink.Title,
+		Interstitial:          shortlink.Interstitial,
+		Warning:               shortlink.Warning,
+		HasPassword:           shortlink.PasswordHash != "",
+		Internal:              shortlink.Internal,
+	}
+}
+
+// saveShortlink stores the shortlink and records the change as a new revision
+func (s *Server) saveShortlink(request *http.Request, shortlink persistence.Shortlink) error {
+	// The destination might have changed, the health checker will pick it up again
+	shortlink.Health = persistence.Health{}
+
+	err := s.repo.SetEntry(request.Context(), shortlink)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.AddRevision(request.Context(), persistence.Revision{
+		Shortlink: shortlink,
+		Editor:    UserFromContext(request.Context()),
+	})
+	if err != nil {
+		log.Errorw("add revision error", "code", shortlink.Code, "error", err)
+	}
+	return nil
+}
+
+func (s *Server) deleteShortlink(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
 	err := checkCsrf(request)
 	if err != nil {
 		http.Error(writer, "csrf token error", 403)
 		return
 	}
 
-	code := params.ByName("code")
-	err = s.repo.DeleteCode(request.Context(), code)
+	domain := request.URL.Query().Get("domain")
+	code := request.URL.Query().Get("code")
+	if !s.checkAccess(writer, request, code) {
+		return
+	}
+	err = s.repo.TrashCode(request.Context(), domain, code)
+	if err == persistence.ErrNotFound {
+		http.Error(writer, "shortlink not found", 404)
+		return
+	}
 	if err != nil {
+		log.Errorw("trash code error", "domain", domain, "code", code, "error", err)
 		http.Error(writer, "could not delete shortlink", 500)
 		return
 	}
@@ -164,17 +533,264 @@ func (s *Server) deleteShortlink(writer http.ResponseWriter, request *http.Reque
 	http.Redirect(writer, request, "/admin/shortlinks", 302)
 }
 
+func (s *Server) listTrash(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	pageParam := request.URL.Query().Get("page")
+	if pageParam == "" {
+		pageParam = "0"
+	}
+
+	page, err := strconv.ParseInt(pageParam, 10, 64)
+	if err != nil {
+		http.Error(writer, "Param page is not an integer", http.StatusBadRequest)
+		return
+	}
+
+	size := int64(5)
+
+	userAccess, err := s.userAccess(request.Context())
+	if err != nil {
+		log.Errorw("get namespaces error", "error", err)
+		http.Error(writer, "Error getting trashed shortlinks", 500)
+		return
+	}
+
+	filter := persistence.Filter{
+		Namespaces: userAccess.namespaces(),
+	}
+
+	shortlinks, total, err := s.repo.GetTrashedEntries(request.Context(), filter, page, size)
+	if err != nil {
+		http.Error(writer, "Error getting trashed shortlinks", 500)
+		return
+	}
+
+	csrfToken := generateCsrf(writer, request)
+
+	err = templates["trash.page.gohtml"].Execute(writer, trashTemplateData{
+		Shortlinks: shortlinks,
+		Page:       page,
+		Total:      total,
+		Size:       size,
+		CSRF:       csrfToken,
+		Domains:    s.options.Domains,
+	})
+	if err != nil {
+		log.Errorw("error rendering page", "url", request.URL.String(), "error", err)
+		http.Error(writer, "Error rendering page", 500)
+	}
+}
+
+func (s *Server) restoreShortlink(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	domain := request.URL.Query().Get("domain")
+	code := request.URL.Query().Get("code")
+	if !s.checkAccess(writer, request, code) {
+		return
+	}
+	_, err = s.repo.GetAlias(request.Context(), domain, code)
+	if err == nil {
+		http.Error(writer, "code is already in use by an alias", 409)
+		return
+	}
+	if err != persistence.ErrNotFound {
+		log.Errorw("get alias error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "could not restore shortlink", 500)
+		return
+	}
+
+	id := request.URL.Query().Get("id")
+	err = s.repo.RestoreCode(request.Context(), domain, code, id)
+	if err == persistence.ErrNotFound {
+		http.Error(writer, "shortlink not found in trash", 404)
+		return
+	}
+	if err == persistence.ErrConflict {
+		http.Error(writer, "code is already in use by another shortlink", 409)
+		return
+	}
+	if err != nil {
+		log.Errorw("restore code error", "domain", domain, "code", code, "id", id, "error", err)
+		http.Error(writer, "could not restore shortlink", 500)
+		return
+	}
+
+	http.Redirect(writer, request, "/admin/trash", 302)
+}
+
+func (s *Server) purgeShortlink(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	domain := request.URL.Query().Get("domain")
+	code := request.URL.Query().Get("code")
+	if !s.checkAccess(writer, request, code) {
+		return
+	}
+	id := request.URL.Query().Get("id")
+	err = s.repo.PurgeCode(request.Context(), domain, code, id)
+	if err == persistence.ErrNotFound {
+		http.Error(writer, "shortlink not found in trash", 404)
+		return
+	}
+	if err != nil {
+		log.Errorw("purge code error", "domain", domain, "code", code, "id", id, "error", err)
+		http.Error(writer, "could not purge shortlink", 500)
+		return
+	}
+
+	http.Redirect(writer, request, "/admin/trash", 302)
+}
+
+// InvalidCode describes why a code can't be used, it is empty for valid codes
+func InvalidCode(code string) string {
+	if !vars.ValidCodePattern.MatchString(code) {
+		return "Allowed characters are " + vars.CodeCharacters + ", path segments are separated by single slashes"
+	}
+
+	// Browsers and proxies resolve dot segments before the request arrives, such codes could never be reached
+	for _, segment := range strings.Split(code, "/") {
+		if segment == "." || segment == ".." {
+			return "Path segments can't be . or .."
+		}
+	}
+
+	for _, prefix := range vars.ReservedCodePrefixes {
+		if strings.HasPrefix(code, prefix) {
+			return "Codes starting with " + prefix + " are reserved"
+		}
+	}
+
+	for _, reserved := range vars.ReservedCodes {
+		if code == reserved {
+			return "The code " + reserved + " is reserved"
+		}
+	}
+	return ""
+}
+
+// parseFormTime combines the date and time inputs of a form, the zero values of the inputs result in a zero time
+func parseFormTime(date, clock, tz string) (time.Time, error) {
+	if (date == "" || date == "0001-01-01") && (clock == "" || clock == "00:00:00") {
+		return time.Time{}, nil
+	}
+	if clock == "" {
+		clock = "00:00:00"
+	}
+	// Browsers omit the seconds if they are zero
+	if len(clock) == len("15:04") {
+		clock += ":00"
+	}
+	return time.Parse("2006-01-02T15:04:05Z07:00", fmt.Sprintf("%sT%s%s", date, clock, tz))
+}
+
+// parseFormSchedule reads the scheduled destinations, rows with an empty URL are skipped to allow removing them
+func parseFormSchedule(request *http.Request, tz string) ([]persistence.ScheduledDestination, error) {
+	dates := request.Form["schedule-date"]
+	clocks := request.Form["schedule-time"]
+	urls := request.Form["schedule-url"]
+	if len(dates) != len(urls) || len(clocks) != len(urls) {
+		return nil, errors.New("incomplete schedule rows")
+	}
+
+	var schedule []persistence.ScheduledDestination
+	for i, url := range urls {
+		if url == "" {
+			continue
+		}
+
+		from, err := parseFormTime(dates[i], clocks[i], tz)
+		if err != nil {
+			return nil, err
+		}
+		if from.IsZero() {
+			return nil, fmt.Errorf("missing start time for %s", url)
+		}
+
+		schedule = append(schedule, persistence.ScheduledDestination{
+			From: from,
+			URL:  url,
+		})
+	}
+
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].From.Before(schedule[j].From)
+	})
+	return schedule, nil
+}
+
+// parseFormRules reads the rules in the order of the rows, rows with an empty URL are skipped to allow removing them
+func parseFormRules(request *http.Request) ([]persistence.Rule, error) {
+	devices := request.Form["rule-device"]
+	languages := request.Form["rule-language"]
+	queries := request.Form["rule-query"]
+	urls := request.Form["rule-url"]
+	if len(devices) != len(urls) || len(languages) != len(urls) || len(queries) != len(urls) {
+		return nil, errors.New("incomplete rule rows")
+	}
+
+	var rules []persistence.Rule
+	for i, url := range urls {
+		if url == "" {
+			continue
+		}
+
+		rules = append(rules, persistence.Rule{
+			Device:   devices[i],
+			Language: strings.TrimSpace(languages[i]),
+			Query:    strings.TrimSpace(queries[i]),
+			URL:      url,
+		})
+	}
+	return rules, nil
+}
+
+// parseFormVariants reads the variants of a split, rows with an empty URL are skipped to allow removing them
+func parseFormVariants(request *http.Request) ([]persistence.Variant, error) {
+	names := request.Form["variant-name"]
+	weights := request.Form["variant-weight"]
+	urls := request.Form["variant-url"]
+	if len(names) != len(urls) || len(weights) != len(urls) {
+		return nil, errors.New("incomplete variant rows")
+	}
+
+	var variants []persistence.Variant
+	for i, url := range urls {
+		if url == "" {
+			continue
+		}
+
+		weight, err := strconv.Atoi(weights[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight for %s", url)
+		}
+
+		variants = append(variants, persistence.Variant{
+			Name:   strings.TrimSpace(names[i]),
+			URL:    url,
+			Weight: weight,
+		})
+	}
+	return variants, nil
+}
+
 func generateCsrf(writer http.ResponseWriter, request *http.Request) string {
 	tokenValue := uuid.New().String()
-	if csrfCookie, err := request.Cookie("__Host-CSRF"); err == nil {
+	if csrfCookie, err := Cookie(request, "CSRF"); err == nil {
 		tokenValue = csrfCookie.Value
 	} else {
-		http.SetCookie(writer, &http.Cookie{
-			Name:     "__Host-CSRF",
+		SetCookie(writer, request, &http.Cookie{
+			Name:     "CSRF",
 			Value:    tokenValue,
 			Path:     "/",
 			Expires:  time.Now().Add(30 * time.Minute),
-			Secure:   true,
 			HttpOnly: true,
 			SameSite: http.SameSiteStrictMode,
 		})
@@ -183,7 +799,7 @@ func generateCsrf(writer http.ResponseWriter, request *http.Request) string {
 }
 
 func checkCsrf(request *http.Request) error {
-	csrfCookie, err := request.Cookie("__Host-CSRF")
+	csrfCookie, err := Cookie(request, "CSRF")
 	if err != nil {
 		return errors.New("csrf cookie not set")
 	}
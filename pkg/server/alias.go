@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"net/http"
+)
+
+func (s *Server) addAlias(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	domain := request.URL.Query().Get("domain")
+	target := request.URL.Query().Get("code")
+
+	code := s.options.CodeNormalization.Normalize(request.PostForm.Get("alias"))
+	if code == "" {
+		http.Error(writer, "Missing alias in form data", 400)
+		return
+	}
+
+	if reason := InvalidCode(code); reason != "" {
+		http.Error(writer, "Invalid alias. "+reason, 400)
+		return
+	}
+
+	if !s.checkAccess(writer, request, target, code) {
+		return
+	}
+
+	// Aliases of aliases would need to be resolved recursively, they always point to the canonical shortlink
+	_, err = s.repo.GetEntryForCode(request.Context(), domain, target)
+	if err == persistence.ErrNotFound {
+		http.Error(writer, "shortlink not found", 404)
+		return
+	}
+	if err != nil {
+		log.Errorw("get code error", "domain", domain, "code", target, "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+
+	inUse, err := s.codeInUse(request.Context(), domain, code)
+	if err != nil {
+		log.Errorw("check code error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+	if inUse {
+		http.Error(writer, "code is already in use by another shortlink or alias", 409)
+		return
+	}
+
+	err = s.repo.SetAlias(request.Context(), persistence.Alias{
+		Domain: domain,
+		Code:   code,
+		Target: target,
+	})
+	if err != nil {
+		log.Errorw("set alias error", "domain", domain, "code", code, "target", target, "error", err)
+		http.Error(writer, "Could not save alias", 500)
+		return
+	}
+
+	http.Redirect(writer, request, editPath(domain, target), 302)
+}
+
+func (s *Server) deleteAlias(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	domain := request.URL.Query().Get("domain")
+	target := request.URL.Query().Get("code")
+	code := request.URL.Query().Get("alias")
+	if !s.checkAccess(writer, request, target) {
+		return
+	}
+
+	alias, err := s.repo.GetAlias(request.Context(), domain, code)
+	if err == persistence.ErrNotFound || (err == nil && alias.Target != target) {
+		http.Error(writer, "alias not found", 404)
+		return
+	}
+	if err != nil {
+		log.Errorw("get alias error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return
+	}
+
+	err = s.repo.DeleteAlias(request.Context(), domain, code)
+	if err != nil {
+		log.Errorw("delete alias error", "domain", domain, "code", code, "error", err)
+		http.Error(writer, "could not delete alias", 500)
+		return
+	}
+
+	http.Redirect(writer, request, editPath(domain, target), 302)
+}
+
+// codeInUse checks shortlinks and aliases, both share the same codes
+func (s *Server) codeInUse(ctx context.Context, domain, code string) (bool, error) {
+	_, err := s.repo.GetEntryForCode(ctx, domain, code)
+	if err != persistence.ErrNotFound {
+		return err == nil, err
+	}
+
+	_, err = s.repo.GetAlias(ctx, domain, code)
+	if err != persistence.ErrNotFound {
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// aliasesByKey collects the aliases of the listed shortlinks, keyed by persistence.Key of the target
+func (s *Server) aliasesByKey(ctx context.Context, shortlinks []persistence.Shortlink) (map[string][]persistence.Alias, error) {
+	aliases := make(map[string][]persistence.Alias)
+	for _, shortlink := range shortlinks {
+		a, err := s.repo.GetAliases(ctx, shortlink.Domain, shortlink.Code)
+		if err != nil {
+			return nil, err
+		}
+		if len(a) != 0 {
+			aliases[persistence.Key(shortlink.Domain, shortlink.Code)] = a
+		}
+	}
+	return aliases, nil
+}
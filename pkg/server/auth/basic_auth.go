@@ -1,39 +1,129 @@
 package auth
 
 import (
-	"crypto/subtle"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/patrick246/shortlink/pkg/observability/logging"
+	"github.com/patrick246/shortlink/pkg/ratelimit"
 	"github.com/patrick246/shortlink/pkg/server"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
-func BasicAuth(username, passwordHash, securedPrefix string) server.MiddlewareFactory {
+var log = logging.CreateLogger("auth")
+
+// BasicAuth protects the secured prefixes with the users, mapped to their bcrypt password hashes. Failed logins are
+// limited per client by loginLimit.
+func BasicAuth(users map[string]string, loginLimit ratelimit.Policy, securedPrefixes ...string) server.MiddlewareFactory {
+	limiter := ratelimit.New("login", loginLimit)
+	unknownUserHash := dummyHash(users)
+	challenge := func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("www-authenticate", `Basic realm="/admin"`)
+		writer.WriteHeader(401)
+	}
+
+	// authenticate returns the user if the credentials are valid, or how long the client has to wait for another try
+	authenticate := func(request *http.Request, reqUser, reqPassword string) (string, time.Duration) {
+		now := time.Now()
+		clientIP := server.ClientIP(request)
+		if wait := limiter.Check(clientIP, now); wait > 0 {
+			log.Warnw("login attempts blocked", "ip", clientIP)
+			return "", wait
+		}
+
+		// Unknown users are checked against a dummy hash, so they take as long as a wrong password
+		passwordHash, known := users[reqUser]
+		if !known {
+			passwordHash = unknownUserHash
+		}
+		passwordCorrect := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(reqPassword)) == nil
+		if !known || !passwordCorrect {
+			limiter.Consume(clientIP, now)
+			log.Warnw("failed login", "user", reqUser, "ip", clientIP)
+			return "", 0
+		}
+		return reqUser, 0
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			if !strings.HasPrefix(request.URL.Path, securedPrefix) {
-				next.ServeHTTP(writer, request)
+			reqUser, reqPassword, ok := request.BasicAuth()
+
+			if hasAnyPrefix(request.URL.Path, securedPrefixes) {
+				if ok {
+					user, wait := authenticate(request, reqUser, reqPassword)
+					if wait > 0 {
+						writer.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+						http.Error(writer, "Too many failed logins", http.StatusTooManyRequests)
+						return
+					}
+					if user != "" {
+						next.ServeHTTP(writer, request.WithContext(server.WithUser(request.Context(), user)))
+						return
+					}
+				}
+				challenge(writer, request)
 				return
 			}
 
-			reqUser, reqPassword, ok := request.BasicAuth()
-			if !ok {
-				writer.Header().Set("www-authenticate", `Basic realm="/admin"`)
-				writer.WriteHeader(401)
-				return
+			// Public paths may still require a login, e.g. for internal shortlinks. Browsers send the credentials of the
+			// admin area along with every request, checking them is expensive and only done if the user is needed.
+			ctx := server.WithChallenge(request.Context(), challenge)
+			if ok {
+				ctx = server.WithLazyUser(ctx, func() string {
+					user, _ := authenticate(request, reqUser, reqPassword)
+					return user
+				})
 			}
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
 
-			passwordCorrect := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(reqPassword)) == nil
-			usernameCorrect := subtle.ConstantTimeCompare([]byte(username), []byte(reqUser)) == 1
+// ReadUsersFile reads additional basic auth users from a file in the htpasswd format, one user:bcrypt-hash per line.
+// Empty lines and lines starting with # are ignored.
+func ReadUsersFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-			if !usernameCorrect || !passwordCorrect {
-				writer.Header().Set("www-authenticate", `Basic realm="/admin"`)
-				writer.WriteHeader(401)
-				return
-			}
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 
-			next.ServeHTTP(writer, request)
-		})
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("line %d: invalid bcrypt hash for user %s: %w", i+1, parts[0], err)
+		}
+		users[parts[0]] = parts[1]
 	}
+	return users, nil
+}
 
+// dummyHash has the cost of the configured hashes, comparing against it takes as long as checking a real user
+func dummyHash(users map[string]string) string {
+	cost := bcrypt.DefaultCost
+	for _, hash := range users {
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil {
+			cost = c
+		}
+		break
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(uuid.New().String()), cost)
+	if err != nil {
+		log.Errorw("error generating dummy hash", "error", err)
+		return ""
+	}
+	return string(hash)
 }
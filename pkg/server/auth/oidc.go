@@ -16,12 +16,15 @@ type OidcConfig struct {
 	ClientId     string
 	ClientSecret string
 	RedirectUri  string
+	// GroupsClaim is the claim of the ID token listing the groups of the user, used for namespace memberships
+	GroupsClaim string
 }
 
-const authCookieName = "__Host-Authentication"
-const stateCookieName = "__Host-State"
+const authCookieName = "Authentication"
+const stateCookieName = "State"
+const returnCookieName = "Return"
 
-func OpenIDConnect(config OidcConfig, securedPrefix string) (server.MiddlewareFactory, error) {
+func OpenIDConnect(config OidcConfig, securedPrefixes ...string) (server.MiddlewareFactory, error) {
 	setupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -42,14 +45,35 @@ func OpenIDConnect(config OidcConfig, securedPrefix string) (server.MiddlewareFa
 		// Discovery returns the OAuth2 endpoints.
 		Endpoint: provider.Endpoint(),
 
-		// "openid" is a required scope for OpenID Connect flows.
-		Scopes: []string{oidc.ScopeOpenID},
+		// "openid" is a required scope for OpenID Connect flows, profile and email provide the username.
+		Scopes: []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+
+	login := func(writer http.ResponseWriter, request *http.Request) {
+		state := uuid.New().String()
+		server.SetCookie(writer, request, &http.Cookie{
+			Name:     stateCookieName,
+			Value:    state,
+			MaxAge:   int(time.Minute.Seconds()),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		server.SetCookie(writer, request, &http.Cookie{
+			Name:     returnCookieName,
+			Value:    request.URL.RequestURI(),
+			MaxAge:   int(time.Minute.Seconds()),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(writer, request, oauth2Config.AuthCodeURL(state), http.StatusFound)
 	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if request.URL.Path == "/oauth2/callback" {
-				stateCookie, err := request.Cookie(stateCookieName)
+				stateCookie, err := server.Cookie(request, stateCookieName)
 				if err != nil {
 					http.Error(writer, "State cookie not present", http.StatusBadRequest)
 					return
@@ -79,53 +103,101 @@ func OpenIDConnect(config OidcConfig, securedPrefix string) (server.MiddlewareFa
 					return
 				}
 
-				http.SetCookie(writer, &http.Cookie{
+				server.SetCookie(writer, request, &http.Cookie{
 					Name:     authCookieName,
 					Value:    rawIDToken,
 					Expires:  idToken.Expiry,
 					Path:     "/",
-					Secure:   true,
 					HttpOnly: true,
 					SameSite: http.SameSiteLaxMode,
 				})
-				http.Redirect(writer, request, "/admin/shortlinks", http.StatusFound)
+				http.Redirect(writer, request, returnPath(request), http.StatusFound)
 				return
 			}
 
-			if !strings.HasPrefix(request.URL.Path, securedPrefix) {
-				next.ServeHTTP(writer, request)
-				return
-			}
-
-			authenticated := oidcCheckAuthenticated(request, verifier)
+			idToken, authenticated := oidcCheckAuthenticated(request, verifier)
 			if !authenticated {
-				state := uuid.New().String()
-				http.SetCookie(writer, &http.Cookie{
-					Name:     stateCookieName,
-					Value:    state,
-					MaxAge:   int(time.Minute.Seconds()),
-					Path:     "/",
-					Secure:   true,
-					HttpOnly: true,
-					SameSite: http.SameSiteLaxMode,
-				})
-				http.Redirect(writer, request, oauth2Config.AuthCodeURL(state), http.StatusFound)
+				if hasAnyPrefix(request.URL.Path, securedPrefixes) {
+					login(writer, request)
+					return
+				}
+
+				// Public paths may still require a login, e.g. for internal shortlinks
+				next.ServeHTTP(writer, request.WithContext(server.WithChallenge(request.Context(), login)))
 				return
 			}
-			next.ServeHTTP(writer, request)
+			ctx := server.WithUser(request.Context(), oidcUsername(idToken))
+			ctx = server.WithGroups(ctx, oidcGroups(idToken, config.GroupsClaim))
+			next.ServeHTTP(writer, request.WithContext(ctx))
 		})
 	}, nil
 }
 
-func oidcCheckAuthenticated(request *http.Request, verifier *oidc.IDTokenVerifier) bool {
-	authCookie, err := request.Cookie(authCookieName)
+// returnPath is the page that started the login, only local paths are accepted to avoid open redirects
+func returnPath(request *http.Request) string {
+	returnCookie, err := server.Cookie(request, returnCookieName)
+	if err != nil {
+		return "/admin/shortlinks"
+	}
+
+	path := returnCookie.Value
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/admin/shortlinks"
+	}
+	return path
+}
+
+func oidcCheckAuthenticated(request *http.Request, verifier *oidc.IDTokenVerifier) (*oidc.IDToken, bool) {
+	authCookie, err := server.Cookie(request, authCookieName)
 	if err != nil {
-		return false
+		return nil, false
 	}
 
-	_, err = verifier.Verify(request.Context(), authCookie.Value)
+	idToken, err := verifier.Verify(request.Context(), authCookie.Value)
 	if err != nil {
-		return false
+		return nil, false
+	}
+	return idToken, true
+}
+
+func oidcUsername(idToken *oidc.IDToken) string {
+	var claims struct {
+		Email             string `json:"email"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err == nil {
+		if claims.PreferredUsername != "" {
+			return claims.PreferredUsername
+		}
+		if claims.Email != "" {
+			return claims.Email
+		}
+	}
+	return idToken.Subject
+}
+
+// oidcGroups reads the groups claim, identity providers either use a list or a single string
+func oidcGroups(idToken *oidc.IDToken, claim string) []string {
+	if claim == "" {
+		return nil
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil
+	}
+
+	switch value := claims[claim].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var groups []string
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+		return groups
 	}
-	return true
+	return nil
 }
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"net/url"
+)
+
+type utmParameter struct {
+	name  string
+	value string
+}
+
+func utmParameters(campaign persistence.Campaign) []utmParameter {
+	return []utmParameter{
+		{name: "utm_source", value: campaign.Source},
+		{name: "utm_medium", value: campaign.Medium},
+		{name: "utm_campaign", value: campaign.Name},
+		{name: "utm_term", value: campaign.Term},
+		{name: "utm_content", value: campaign.Content},
+	}
+}
+
+// appendCampaign adds the UTM parameters of the campaign to the destination. Parameters already present in the
+// destination take precedence, so single destinations can be tagged differently.
+func appendCampaign(destination string, campaign persistence.Campaign) (string, error) {
+	if campaign == (persistence.Campaign{}) {
+		return destination, nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for _, parameter := range utmParameters(campaign) {
+		if _, exists := query[parameter.name]; exists || parameter.value == "" {
+			continue
+		}
+		query.Set(parameter.name, parameter.value)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// validateCampaign requires the parameters analytics tools need to attribute the clicks, if any parameter is set
+func validateCampaign(campaign persistence.Campaign) string {
+	if campaign == (persistence.Campaign{}) {
+		return ""
+	}
+	if campaign.Source == "" || campaign.Medium == "" || campaign.Name == "" {
+		return "Source, medium and campaign name are required for UTM parameters"
+	}
+	return ""
+}
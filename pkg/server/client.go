@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// client is the original client of a request, reported by trusted proxies
+type client struct {
+	ip     string
+	scheme string
+	// plainHTTP is only set if the client is known to use plain HTTP, the scheme of requests from untrusted proxies
+	// can't be known
+	plainHTTP bool
+}
+
+// hop is one entry of the forwarding headers, the first hop is the original client
+type hop struct {
+	ip    string
+	proto string
+}
+
+// ParseTrustedProxies parses a comma separated list of CIDRs, single addresses are also accepted
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// resolveClient determines the client address and scheme before any other handler runs. Forwarding headers are only
+// used if the request comes from a trusted proxy, otherwise clients could spoof their address.
+func (s *Server) resolveClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := client{
+			ip:     remoteIP(r),
+			scheme: "http",
+		}
+		if r.TLS != nil {
+			c.scheme = "https"
+		}
+
+		// Without trusted proxies a plain request can still come from a TLS terminating proxy
+		schemeKnown := r.TLS != nil || s.options.PlainHTTPCookies || (len(s.options.TrustedProxies) != 0 && !s.trustedProxy(c.ip))
+
+		// The headers are walked from the nearest proxy to the client, until the first address that isn't trusted
+		if s.trustedProxy(c.ip) {
+			hops := forwardedHops(r)
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(hops[i].ip)
+				if ip == nil {
+					break
+				}
+
+				c.ip = ip.String()
+				if hops[i].proto == "http" || hops[i].proto == "https" {
+					c.scheme = hops[i].proto
+					schemeKnown = true
+				}
+				if !s.trustedProxy(c.ip) {
+					break
+				}
+			}
+		}
+
+		c.plainHTTP = schemeKnown && c.scheme == "http"
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientContextKey, c)))
+	})
+}
+
+func (s *Server) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.options.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops reads the standard Forwarded header, falling back to X-Forwarded-For and X-Forwarded-Proto
+func forwardedHops(r *http.Request) []hop {
+	var hops []hop
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) != 0 {
+		for _, element := range splitHeader(forwarded) {
+			var h hop
+			for _, pair := range strings.Split(element, ";") {
+				key, value := splitPair(pair)
+				switch strings.ToLower(key) {
+				case "for":
+					h.ip = forwardedIP(value)
+				case "proto":
+					h.proto = strings.ToLower(value)
+				}
+			}
+			hops = append(hops, h)
+		}
+		return hops
+	}
+
+	addresses := splitHeader(r.Header.Values("X-Forwarded-For"))
+	protos := splitHeader(r.Header.Values("X-Forwarded-Proto"))
+	for i, address := range addresses {
+		h := hop{ip: address}
+		// Proxies that don't append to X-Forwarded-Proto report the scheme of their client for all hops
+		if len(protos) == len(addresses) {
+			h.proto = strings.ToLower(protos[i])
+		} else if len(protos) != 0 {
+			h.proto = strings.ToLower(protos[len(protos)-1])
+		}
+		hops = append(hops, h)
+	}
+	return hops
+}
+
+func splitHeader(values []string) []string {
+	var entries []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	return entries
+}
+
+func splitPair(pair string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], strings.Trim(parts[1], `"`)
+}
+
+// forwardedIP removes the port and the brackets of IPv6 addresses, e.g. [2001:db8::1]:4711
+func forwardedIP(value string) string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP is the address of the client used for logging and rate limiting, reported by trusted proxies
+func ClientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientContextKey).(client); ok {
+		return c.ip
+	}
+	return remoteIP(r)
+}
+
+// ClientScheme is the scheme the client used to connect, http or https
+func ClientScheme(r *http.Request) string {
+	if c, ok := r.Context().Value(clientContextKey).(client); ok {
+		return c.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
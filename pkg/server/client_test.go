@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		networks []string
+		invalid  bool
+	}{
+		{name: "empty", value: ""},
+		{name: "cidr", value: "10.0.0.0/8", networks: []string{"10.0.0.0/8"}},
+		{name: "single ipv4", value: "192.168.1.10", networks: []string{"192.168.1.10/32"}},
+		{name: "single ipv6", value: "2001:db8::1", networks: []string{"2001:db8::1/128"}},
+		{name: "list with spaces", value: " 10.0.0.0/8 , ,127.0.0.1", networks: []string{"10.0.0.0/8", "127.0.0.1/32"}},
+		{name: "invalid address", value: "10.0.0.0/8,proxy.local", invalid: true},
+		{name: "invalid cidr", value: "10.0.0.0/33", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxies, err := ParseTrustedProxies(test.value)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", proxies)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(proxies) != len(test.networks) {
+				t.Fatalf("expected %v, got %v", test.networks, proxies)
+			}
+			for i, network := range test.networks {
+				if proxies[i].String() != network {
+					t.Errorf("expected %s, got %s", network, proxies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveClient(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		proxies    bool
+		plainHTTP  bool
+		tls        bool
+		remoteAddr string
+		headers    map[string][]string
+		ip         string
+		scheme     string
+		plain      bool
+	}{
+		{
+			name:       "no proxies configured",
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}, "X-Forwarded-Proto": {"https"}},
+			ip:         "10.0.0.1",
+			scheme:     "http",
+		},
+		{
+			name:       "no proxies configured with plain http cookies",
+			plainHTTP:  true,
+			remoteAddr: "10.0.0.1:4711",
+			ip:         "10.0.0.1",
+			scheme:     "http",
+			plain:      true,
+		},
+		{
+			name:       "tls without proxy",
+			tls:        true,
+			remoteAddr: "203.0.113.7:4711",
+			ip:         "203.0.113.7",
+			scheme:     "https",
+		},
+		{
+			name:       "untrusted remote spoofing the headers",
+			proxies:    true,
+			remoteAddr: "203.0.113.7:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}},
+			ip:         "203.0.113.7",
+			scheme:     "http",
+			plain:      true,
+		},
+		{
+			name:       "trusted proxy",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}, "X-Forwarded-Proto": {"https"}},
+			ip:         "203.0.113.7",
+			scheme:     "https",
+		},
+		{
+			name:       "chain stops at the first untrusted address",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.2"}},
+			ip:         "203.0.113.7",
+			scheme:     "http",
+		},
+		{
+			name:       "chain of trusted proxies",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			ip:         "10.0.0.3",
+			scheme:     "http",
+		},
+		{
+			name:       "chain stops at an invalid address",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7, unknown, 10.0.0.2"}},
+			ip:         "10.0.0.2",
+			scheme:     "http",
+		},
+		{
+			name:       "proto per hop",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7, 10.0.0.2"}, "X-Forwarded-Proto": {"http, https"}},
+			ip:         "203.0.113.7",
+			scheme:     "http",
+			plain:      true,
+		},
+		{
+			name:       "single proto for all hops",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7, 10.0.0.2"}, "X-Forwarded-Proto": {"HTTPS"}},
+			ip:         "203.0.113.7",
+			scheme:     "https",
+		},
+		{
+			name:       "unknown proto leaves the scheme unknown",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}, "X-Forwarded-Proto": {"gopher"}},
+			ip:         "203.0.113.7",
+			scheme:     "http",
+		},
+		{
+			name:       "forwarded header",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"Forwarded": {`for=203.0.113.7;proto=https, for=10.0.0.2`}},
+			ip:         "203.0.113.7",
+			scheme:     "https",
+		},
+		{
+			name:       "forwarded header with quoted ipv6 and port",
+			proxies:    true,
+			remoteAddr: "[2001:db8::2]:4711",
+			headers:    map[string][]string{"Forwarded": {`For="[2001:db9::7]:4711";Proto=HTTPS`}},
+			ip:         "2001:db9::7",
+			scheme:     "https",
+		},
+		{
+			name:       "forwarded header takes precedence",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers: map[string][]string{
+				"Forwarded":       {"for=203.0.113.7"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			ip:     "203.0.113.7",
+			scheme: "http",
+		},
+		{
+			name:       "obfuscated forwarded identifier",
+			proxies:    true,
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"Forwarded": {"for=_hidden"}},
+			ip:         "10.0.0.1",
+			scheme:     "http",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{options: Options{PlainHTTPCookies: test.plainHTTP}}
+			if test.proxies {
+				s.options.TrustedProxies = proxies
+			}
+
+			var ip, scheme string
+			var plain bool
+			handler := s.resolveClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ip = ClientIP(r)
+				scheme = ClientScheme(r)
+				plain = !secureCookies(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/code", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for key, values := range test.headers {
+				for _, value := range values {
+					r.Header.Add(key, value)
+				}
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if ip != test.ip {
+				t.Errorf("expected client ip %s, got %s", test.ip, ip)
+			}
+			if scheme != test.scheme {
+				t.Errorf("expected scheme %s, got %s", test.scheme, scheme)
+			}
+			if plain != test.plain {
+				t.Errorf("expected plain http %v, got %v", test.plain, plain)
+			}
+		})
+	}
+}
@@ -1,45 +1,251 @@
 package server
 
 import (
+	"context"
 	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/patrick246/shortlink/pkg/ratelimit"
 	"github.com/prometheus/client_golang/prometheus"
 	"net/http"
-	"regexp"
+	"net/url"
+	"strings"
 	"time"
 )
 
-var codePathRegex = regexp.MustCompile("^/([^/]+)$")
+// RedirectStatuses are the status codes that can be used for redirects
+var RedirectStatuses = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
 
 var codeUsageCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "shortlink_code_request_count",
 	Help: "Counts the number of requests for a shortcode",
-}, []string{"shortcode"})
+}, []string{"domain", "shortcode", "variant"})
 
 func (s *Server) handleCodeRequests(w http.ResponseWriter, r *http.Request) {
-	matches := codePathRegex.FindStringSubmatch(r.URL.Path)
-	if len(matches) != 2 {
-		http.Error(w, "Not found", 404)
+	now := time.Now()
+	clientIP := ClientIP(r)
+	if wait := s.redirectLimiter.Allow(clientIP, now); wait > 0 {
+		tooManyRequests(w, wait)
 		return
 	}
-	code := matches[1]
 
-	shortLink, err := s.repo.GetEntryForCode(r.Context(), code)
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		s.notFound(w, clientIP, now)
+		return
+	}
+
+	domain := s.requestDomain(r.Host)
+	shortLink, remainingPath, previewSuffix, err := s.resolvePath(r.Context(), domain, path)
 	if err == persistence.ErrNotFound {
-		log.Warnw("invalid code", "code", code, "ip", r.RemoteAddr)
-		http.Error(w, "Not found", 404)
+		log.Warnw("invalid code", "domain", domain, "code", path, "ip", clientIP)
+		s.unknownCode(w, r, domain, path, now)
 		return
 	}
 	if err != nil {
-		log.Errorw("error getting code", "code", code, "error", err, "ip", r.RemoteAddr)
+		log.Errorw("error getting code", "domain", domain, "code", path, "error", err, "ip", clientIP)
 		http.Error(w, "Internal Server Error", 500)
 		return
 	}
+	code := shortLink.Code
+
+	_, preview := r.URL.Query()["preview"]
+	preview = preview || previewSuffix
+
+	if !shortLink.IsActive(now) {
+		s.notFound(w, clientIP, now)
+		return
+	}
+
+	if remainingPath != "" && !shortLink.Passthrough && !shortLink.Template {
+		s.notFound(w, clientIP, now)
+		return
+	}
+
+	destination, variant := targetDestination(w, r, shortLink, now)
+	if len(shortLink.Rules) != 0 {
+		// Caches must not reuse the redirect for clients the rules treat differently
+		w.Header().Add("Vary", "User-Agent, Accept-Language")
+	}
+	if shortLink.Template {
+		destination, err = fillPlaceholders(destination, remainingPath, r.URL.Query())
+		if err != nil {
+			log.Warnw("template not filled", "domain", domain, "code", code, "path", remainingPath, "error", err, "ip", clientIP)
+			s.notFound(w, clientIP, now)
+			return
+		}
+	} else if shortLink.Passthrough {
+		query := r.URL.Query()
+		query.Del("preview")
+		destination, err = passthroughURL(destination, remainingPath, query)
+		if err != nil {
+			log.Errorw("invalid destination", "code", code, "error", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+	}
+
+	destination, err = appendCampaign(destination, shortLink.Campaign)
+	if err != nil {
+		log.Errorw("invalid destination", "code", code, "error", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	// Without a configured authentication there is no challenge, internal shortlinks are public then
+	challenge := ChallengeFromContext(r.Context())
+	if shortLink.Internal && UserFromContext(r.Context()) == "" && challenge != nil {
+		challenge(w, r)
+		return
+	}
+
+	if shortLink.PasswordHash != "" && !s.unlocked(r, shortLink) {
+		s.handlePasswordPrompt(w, r, shortLink)
+		return
+	}
+
+	if preview {
+		s.renderPreview(w, r, shortLink, destination)
+		return
+	}
+
+	codeUsageCounter.WithLabelValues(domain, code, variant).Inc()
+	if shortLink.Interstitial {
+		s.renderPreview(w, r, shortLink, destination)
+		return
+	}
+	http.Redirect(w, r, destination, s.redirectStatus(shortLink))
+}
+
+func (s *Server) renderPreview(w http.ResponseWriter, r *http.Request, shortLink persistence.Shortlink, destination string) {
+	err := templates["preview.page.gohtml"].Execute(w, previewTemplateData{
+		Code:        shortLink.Code,
+		Title:       shortLink.Title,
+		Destination: destination,
+		TTL:         shortLink.TTL,
+		Warning:     shortLink.Warning,
+	})
+	if err != nil {
+		log.Errorw("error rendering page", "url", r.URL.String(), "error", err)
+		http.Error(w, "Error rendering page", 500)
+	}
+}
 
-	if !shortLink.TTL.IsZero() && shortLink.TTL.Before(time.Now()) {
-		http.Error(w, "Not found", 404)
+// passthroughURL appends the remaining path to the path of the destination and adds the query parameters.
+// Parameters already present in the destination take precedence over request parameters with the same name.
+func passthroughURL(destination, remainingPath string, query url.Values) (string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	if remainingPath != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + remainingPath
+		u.RawPath = ""
+	}
+
+	destinationQuery := u.Query()
+	for key, values := range query {
+		if _, exists := destinationQuery[key]; exists {
+			continue
+		}
+		destinationQuery[key] = values
+	}
+	u.RawQuery = destinationQuery.Encode()
+
+	return u.String(), nil
+}
+
+func (s *Server) redirectStatus(shortLink persistence.Shortlink) int {
+	if shortLink.RedirectStatus == 0 {
+		return s.options.DefaultRedirectStatus
+	}
+	return shortLink.RedirectStatus
+}
+
+func ValidRedirectStatus(status int) bool {
+	for _, s := range RedirectStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath finds the shortlink with the longest code the path starts with, whole path segments are removed until one
+// is found. The removed segments are returned as remaining path for passthrough shortlinks.
+func (s *Server) resolvePath(ctx context.Context, domain, path string) (shortLink persistence.Shortlink, remainingPath string, preview bool, err error) {
+	code := path
+	for {
+		shortLink, err = s.lookup(ctx, domain, code)
+		// '+' is valid in codes, so the preview suffix is only considered if there is no code including it
+		if err == persistence.ErrNotFound && strings.HasSuffix(code, "+") && remainingPath == "" {
+			shortLink, err = s.lookup(ctx, domain, strings.TrimSuffix(code, "+"))
+			preview = err == nil
+		}
+		if err != persistence.ErrNotFound {
+			return shortLink, remainingPath, preview, err
+		}
+
+		i := strings.LastIndex(code, "/")
+		if i == -1 {
+			return persistence.Shortlink{}, "", false, persistence.ErrNotFound
+		}
+		code, remainingPath = code[:i], code[i:]+remainingPath
+	}
+}
+
+// lookup tries the exact code before the normalized one, codes colliding after normalization are only found exactly.
+// Aliases resolve to their target shortlink.
+func (s *Server) lookup(ctx context.Context, domain, code string) (persistence.Shortlink, error) {
+	codes := []string{code}
+	if normalized := s.options.CodeNormalization.Normalize(code); normalized != code {
+		codes = append(codes, normalized)
+	}
+
+	for _, c := range codes {
+		shortLink, err := s.repo.GetEntryForCode(ctx, domain, c)
+		if err != persistence.ErrNotFound {
+			return shortLink, err
+		}
+	}
+
+	for _, c := range codes {
+		alias, err := s.repo.GetAlias(ctx, domain, c)
+		if err == persistence.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return persistence.Shortlink{}, err
+		}
+		return s.repo.GetEntryForCode(ctx, domain, alias.Target)
+	}
+	return persistence.Shortlink{}, persistence.ErrNotFound
+}
+
+func (s *Server) notFound(w http.ResponseWriter, clientIP string, now time.Time) {
+	if s.missBlocked(w, clientIP, now) {
 		return
 	}
+	http.Error(w, "Not found", 404)
+}
+
+// missBlocked counts a miss of the client, clients guessing codes run out of misses and get a 429 instead of a 404.
+// It is only called after a failed lookup, so the misses of clients sharing an address never block existing codes.
+func (s *Server) missBlocked(w http.ResponseWriter, clientIP string, now time.Time) bool {
+	if wait := s.missLimiter.Check(clientIP, now); wait > 0 {
+		log.Warnw("code lookups blocked", "ip", clientIP)
+		tooManyRequests(w, wait)
+		return true
+	}
+	s.missLimiter.Consume(clientIP, now)
+	return false
+}
 
-	codeUsageCounter.WithLabelValues(code).Inc()
-	http.Redirect(w, r, shortLink.URL, http.StatusFound)
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
 }
@@ -0,0 +1,28 @@
+package server
+
+import "net/http"
+
+const hostCookiePrefix = "__Host-"
+
+// SetCookie adds the __Host- prefix and the Secure attribute. Browsers reject both on plain HTTP, so they are left out if
+// the client is known to use plain HTTP.
+func SetCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) {
+	if secureCookies(r) {
+		cookie.Name = hostCookiePrefix + cookie.Name
+		cookie.Secure = true
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Cookie reads a cookie set by SetCookie
+func Cookie(r *http.Request, name string) (*http.Cookie, error) {
+	if secureCookies(r) {
+		name = hostCookiePrefix + name
+	}
+	return r.Cookie(name)
+}
+
+func secureCookies(r *http.Request) bool {
+	c, ok := r.Context().Value(clientContextKey).(client)
+	return !ok || !c.plainHTTP
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultDomain is used for requests with an unknown host and for shortlinks created before domains were configured
+func (s *Server) defaultDomain() string {
+	if len(s.options.Domains) == 0 {
+		return ""
+	}
+	return s.options.Domains[0]
+}
+
+// requestDomain selects the domain of the shortlinks by the host the client requested
+func (s *Server) requestDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+	for _, domain := range s.options.Domains {
+		if host == domain {
+			return domain
+		}
+	}
+	return s.defaultDomain()
+}
+
+func (s *Server) validDomain(domain string) bool {
+	if len(s.options.Domains) == 0 {
+		return domain == ""
+	}
+
+	for _, d := range s.options.Domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// editPath is the admin page of a shortlink, code and domain are passed as query parameters
+func editPath(domain, code string) string {
+	query := url.Values{}
+	query.Set("code", code)
+	if domain != "" {
+		query.Set("domain", domain)
+	}
+	return "/admin/shortlinks/edit?" + query.Encode()
+}
+
+// createPath links to the create form of the admin list, prefilled with the code
+func createPath(domain, code string) string {
+	query := url.Values{"code": {code}}
+	if domain != "" {
+		query.Set("domain", domain)
+	}
+	return "/admin/shortlinks?" + query.Encode() + "#create"
+}
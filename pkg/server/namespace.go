@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/patrick246/shortlink/pkg/vars"
+	"net/http"
+	"strings"
+)
+
+// groupMemberPrefix marks members of admins and namespaces that are groups of the identity provider
+const groupMemberPrefix = "group:"
+
+// access describes which codes the current user may manage
+type access struct {
+	admin bool
+	// prefixes of the namespaces the user is a member of, only used for users that aren't admins
+	prefixes []string
+}
+
+// userAccess looks up the namespaces of the current user. Without configured admins every user is an admin.
+func (s *Server) userAccess(ctx context.Context) (access, error) {
+	user := UserFromContext(ctx)
+	groups := GroupsFromContext(ctx)
+	if len(s.options.Admins) == 0 || isMember(s.options.Admins, user, groups) {
+		return access{admin: true}, nil
+	}
+
+	namespaces, err := s.repo.GetNamespaces(ctx)
+	if err != nil {
+		return access{}, err
+	}
+
+	a := access{prefixes: []string{}}
+	for _, namespace := range namespaces {
+		if isMember(namespace.Members, user, groups) {
+			a.prefixes = append(a.prefixes, namespace.Prefix)
+		}
+	}
+	return a, nil
+}
+
+func (a access) mayManage(code string) bool {
+	if a.admin {
+		return true
+	}
+
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(code, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaces restricts the listed shortlinks, admins see all of them
+func (a access) namespaces() []string {
+	if a.admin {
+		return nil
+	}
+	return a.prefixes
+}
+
+// checkAccess answers with 403 if the user may not manage any of the codes. It returns false if the request has been
+// answered.
+func (s *Server) checkAccess(writer http.ResponseWriter, request *http.Request, codes ...string) bool {
+	a, err := s.userAccess(request.Context())
+	if err != nil {
+		log.Errorw("get namespaces error", "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return false
+	}
+
+	for _, code := range codes {
+		if !a.mayManage(code) {
+			log.Warnw("code outside of the namespaces of the user", "user", UserFromContext(request.Context()), "code", code)
+			http.Error(writer, "You may only manage the codes of your namespaces", 403)
+			return false
+		}
+	}
+	return true
+}
+
+// checkAdmin answers with 403 if the user isn't an admin. It returns false if the request has been answered.
+func (s *Server) checkAdmin(writer http.ResponseWriter, request *http.Request) bool {
+	a, err := s.userAccess(request.Context())
+	if err != nil {
+		log.Errorw("get namespaces error", "error", err)
+		http.Error(writer, "Error getting database data", 500)
+		return false
+	}
+
+	if !a.admin {
+		http.Error(writer, "Only admins may manage namespaces", 403)
+		return false
+	}
+	return true
+}
+
+func isMember(members []string, user string, groups []string) bool {
+	for _, member := range members {
+		if strings.HasPrefix(member, groupMemberPrefix) {
+			for _, group := range groups {
+				if member == groupMemberPrefix+group {
+					return true
+				}
+			}
+			continue
+		}
+
+		if user != "" && member == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) listNamespaces(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	if !s.checkAdmin(writer, request) {
+		return
+	}
+
+	namespaces, err := s.repo.GetNamespaces(request.Context())
+	if err != nil {
+		log.Errorw("get namespaces error", "error", err)
+		http.Error(writer, "Error getting namespaces", 500)
+		return
+	}
+
+	err = templates["namespaces.page.gohtml"].Execute(writer, namespacesTemplateData{
+		Namespaces: namespaces,
+		CSRF:       generateCsrf(writer, request),
+	})
+	if err != nil {
+		log.Errorw("error rendering page", "url", request.URL.String(), "error", err)
+		http.Error(writer, "Error rendering page", 500)
+	}
+}
+
+func (s *Server) saveNamespace(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	if !s.checkAdmin(writer, request) {
+		return
+	}
+
+	prefix := request.PostForm.Get("prefix")
+	if !vars.ValidCodePattern.MatchString(strings.TrimSuffix(prefix, "/")) {
+		http.Error(writer, "Invalid prefix. Allowed characters are "+vars.CodeCharacters+" and slashes", 400)
+		return
+	}
+
+	var members []string
+	for _, member := range strings.Split(request.PostForm.Get("members"), ",") {
+		member = strings.TrimSpace(member)
+		if member != "" {
+			members = append(members, member)
+		}
+	}
+
+	err = s.repo.SetNamespace(request.Context(), persistence.Namespace{
+		Prefix:  prefix,
+		Members: members,
+	})
+	if err != nil {
+		log.Errorw("set namespace error", "prefix", prefix, "error", err)
+		http.Error(writer, "Could not save namespace", 500)
+		return
+	}
+
+	log.Infow("namespace saved", "prefix", prefix, "members", members, "user", UserFromContext(request.Context()))
+	http.Redirect(writer, request, "/admin/namespaces", 302)
+}
+
+func (s *Server) deleteNamespace(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	err := checkCsrf(request)
+	if err != nil {
+		http.Error(writer, "csrf token error", 403)
+		return
+	}
+
+	if !s.checkAdmin(writer, request) {
+		return
+	}
+
+	prefix := request.URL.Query().Get("prefix")
+	err = s.repo.DeleteNamespace(request.Context(), prefix)
+	if err != nil {
+		log.Errorw("delete namespace error", "prefix", prefix, "error", err)
+		http.Error(writer, "could not delete namespace", 500)
+		return
+	}
+
+	log.Infow("namespace deleted", "prefix", prefix, "user", UserFromContext(request.Context()))
+	http.Redirect(writer, request, "/admin/namespaces", 302)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/patrick246/shortlink/pkg/ratelimit"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const unlockCookiePrefix = "Unlock-"
+
+var unlockCookieLifetime = 15 * time.Minute
+
+// HashPassword creates the bcrypt hash stored for password protected shortlinks
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func (s *Server) handlePasswordPrompt(w http.ResponseWriter, r *http.Request, shortLink persistence.Shortlink) {
+	if r.Method != http.MethodPost {
+		s.renderPasswordPrompt(w, r, shortLink, http.StatusUnauthorized, "")
+		return
+	}
+
+	// Failed attempts are limited per client and shortlink
+	now := time.Now()
+	attemptKey := ClientIP(r) + " " + persistence.Key(shortLink.Domain, shortLink.Code)
+	if wait := s.passwordLimiter.Check(attemptKey, now); wait > 0 {
+		log.Warnw("password attempts blocked", "domain", shortLink.Domain, "code", shortLink.Code, "ip", ClientIP(r))
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		s.renderPasswordPrompt(w, r, shortLink, http.StatusTooManyRequests, "Too many failed attempts, please try again later.")
+		return
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(shortLink.PasswordHash), []byte(r.PostFormValue("password")))
+	if err != nil {
+		s.passwordLimiter.Consume(attemptKey, now)
+		log.Warnw("wrong shortlink password", "code", shortLink.Code, "ip", ClientIP(r))
+		s.renderPasswordPrompt(w, r, shortLink, http.StatusUnauthorized, "Wrong password.")
+		return
+	}
+
+	expires := now.Add(unlockCookieLifetime)
+	SetCookie(w, r, &http.Cookie{
+		Name:     unlockCookieName(shortLink.Domain, shortLink.Code),
+		Value:    s.signUnlock(shortLink, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
+
+func (s *Server) renderPasswordPrompt(w http.ResponseWriter, r *http.Request, shortLink persistence.Shortlink, status int, message string) {
+	w.WriteHeader(status)
+	err := templates["password.page.gohtml"].Execute(w, passwordTemplateData{
+		Code:  shortLink.Code,
+		Title: shortLink.Title,
+		Error: message,
+	})
+	if err != nil {
+		log.Errorw("error rendering page", "url", r.URL.String(), "error", err)
+	}
+}
+
+// unlocked checks for a valid cookie from a previous successful password entry
+func (s *Server) unlocked(r *http.Request, shortLink persistence.Shortlink) bool {
+	cookie, err := Cookie(r, unlockCookieName(shortLink.Domain, shortLink.Code))
+	if err != nil {
+		return false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expiresUnix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if time.Now().After(expires) {
+		return false
+	}
+
+	return hmac.Equal([]byte(cookie.Value), []byte(s.signUnlock(shortLink, expires)))
+}
+
+// signUnlock binds the cookie to the domain and code and the current password, changing the password invalidates all
+// cookies
+func (s *Server) signUnlock(shortLink persistence.Shortlink, expires time.Time) string {
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+
+	mac := hmac.New(sha256.New, s.options.CookieSecret)
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%s", persistence.Key(shortLink.Domain, shortLink.Code), shortLink.PasswordHash, expiresUnix)
+	return expiresUnix + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unlockCookieName derives a cookie name from the domain and code, codes may contain characters not allowed in cookie
+// names
+func unlockCookieName(domain, code string) string {
+	sum := sha256.Sum256([]byte(persistence.Key(domain, code)))
+	return unlockCookiePrefix + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// placeholderPattern matches the placeholders of template destinations. Numbers refer to the segments of the remaining
+// path, e.g. {1} is ABC-123 for /jira/ABC-123, names refer to query parameters.
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_\-]+)\}`)
+
+var errPlaceholderValue = errors.New("no valid value for placeholder")
+
+// validateTemplate makes sure the placeholders can only change the path, the query or the fragment of a destination,
+// otherwise requests could redirect to any host
+func validateTemplate(destination string) error {
+	matches := placeholderPattern.FindAllStringIndex(destination, -1)
+	if len(matches) == 0 {
+		return errors.New("template destinations need at least one placeholder, e.g. {1} or {q}")
+	}
+
+	if strings.ContainsAny(placeholderPattern.ReplaceAllString(destination, ""), "{}") {
+		return errors.New("unbalanced braces, placeholders look like {1} or {name}")
+	}
+
+	prefix := destination[:matches[0][0]]
+	i := strings.Index(prefix, "://")
+	if i == -1 || !strings.ContainsAny(prefix[i+len("://"):], "/?#") {
+		return errors.New("placeholders can only be used in the path, the query or the fragment")
+	}
+	return nil
+}
+
+// sampleDestination fills all placeholders, so the destination can be checked against the URL policy
+func sampleDestination(destination string) string {
+	return placeholderPattern.ReplaceAllString(destination, "x")
+}
+
+// fillPlaceholders replaces the placeholders with the segments of the remaining path and the query parameters. The
+// values are escaped for the part of the URL they are inserted into. All segments of the remaining path have to be used.
+func fillPlaceholders(destination, remainingPath string, query url.Values) (string, error) {
+	var segments []string
+	if trimmed := strings.Trim(remainingPath, "/"); trimmed != "" {
+		segments = strings.Split(trimmed, "/")
+	}
+
+	var filled strings.Builder
+	last, usedSegments := 0, 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(destination, -1) {
+		filled.WriteString(destination[last:match[0]])
+		last = match[1]
+
+		name := destination[match[2]:match[3]]
+		var value string
+		if n, err := strconv.Atoi(name); err == nil {
+			if n >= 1 && n <= len(segments) {
+				value = segments[n-1]
+			}
+			if n > usedSegments {
+				usedSegments = n
+			}
+		} else {
+			value = query.Get(name)
+		}
+
+		inPath := !strings.ContainsAny(destination[:match[0]], "?#")
+		// Dot segments would be resolved by the client and lead outside of the intended path
+		if value == "" || (inPath && (value == "." || value == "..")) {
+			return "", fmt.Errorf("%w {%s}", errPlaceholderValue, name)
+		}
+
+		if inPath || strings.Contains(destination[:match[0]], "#") {
+			filled.WriteString(url.PathEscape(value))
+		} else {
+			filled.WriteString(url.QueryEscape(value))
+		}
+	}
+	filled.WriteString(destination[last:])
+
+	if usedSegments < len(segments) {
+		return "", fmt.Errorf("the destination only uses %d of %d path segments", usedSegments, len(segments))
+	}
+	return filled.String(), nil
+}
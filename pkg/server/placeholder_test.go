@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		destination string
+		invalid     bool
+	}{
+		{destination: "https://jira.example.com/browse/{1}"},
+		{destination: "https://search.example.com/?q={q}"},
+		{destination: "https://example.com#{section}"},
+		{destination: "https://example.com/{1}/{2}?lang={lang}"},
+		{destination: "https://example.com/docs", invalid: true},
+		{destination: "https://{1}.example.com/", invalid: true},
+		{destination: "https://example.com{1}", invalid: true},
+		{destination: "{1}", invalid: true},
+		{destination: "https://example.com/{1", invalid: true},
+		{destination: "https://example.com/{1}}", invalid: true},
+		{destination: "https://example.com/{a.b}", invalid: true},
+	}
+
+	for _, test := range tests {
+		err := validateTemplate(test.destination)
+		if test.invalid && err == nil {
+			t.Errorf("%s: expected an error", test.destination)
+		}
+		if !test.invalid && err != nil {
+			t.Errorf("%s: expected no error, got %v", test.destination, err)
+		}
+	}
+}
+
+func TestFillPlaceholders(t *testing.T) {
+	tests := []struct {
+		name          string
+		destination   string
+		remainingPath string
+		query         url.Values
+		expected      string
+		invalid       bool
+	}{
+		{
+			name:          "path segment",
+			destination:   "https://jira.example.com/browse/{1}",
+			remainingPath: "/ABC-123",
+			expected:      "https://jira.example.com/browse/ABC-123",
+		},
+		{
+			name:          "multiple path segments",
+			destination:   "https://example.com/{2}/{1}",
+			remainingPath: "/first/second/",
+			expected:      "https://example.com/second/first",
+		},
+		{
+			name:          "path segment is escaped",
+			destination:   "https://example.com/wiki/{1}",
+			remainingPath: "/a b?c#d&e",
+			expected:      "https://example.com/wiki/a%20b%3Fc%23d&e",
+		},
+		{
+			name:        "slashes can't add path segments",
+			destination: "https://example.com/users/{name}",
+			query:       url.Values{"name": {"../admin"}},
+			expected:    "https://example.com/users/..%2Fadmin",
+		},
+		{
+			name:        "query value is escaped",
+			destination: "https://search.example.com/?q={q}&lang=en",
+			query:       url.Values{"q": {"a b&lang=de#top"}},
+			expected:    "https://search.example.com/?q=a+b%26lang%3Dde%23top&lang=en",
+		},
+		{
+			name:          "path segment in the query",
+			destination:   "https://search.example.com/?q={1}",
+			remainingPath: "/100%",
+			expected:      "https://search.example.com/?q=100%25",
+		},
+		{
+			name:        "fragment is escaped like a path",
+			destination: "https://example.com/docs#{section}",
+			query:       url.Values{"section": {"a b#c"}},
+			expected:    "https://example.com/docs#a%20b%23c",
+		},
+		{
+			name:          "dot segments in the query are allowed",
+			destination:   "https://example.com/?path={1}",
+			remainingPath: "/..",
+			expected:      "https://example.com/?path=..",
+		},
+		{
+			name:          "dot segment in the path",
+			destination:   "https://example.com/files/{1}",
+			remainingPath: "/..",
+			invalid:       true,
+		},
+		{
+			name:        "dot segment from the query in the path",
+			destination: "https://example.com/files/{name}",
+			query:       url.Values{"name": {"."}},
+			invalid:     true,
+		},
+		{
+			name:          "missing path segment",
+			destination:   "https://example.com/{1}/{2}",
+			remainingPath: "/first",
+			invalid:       true,
+		},
+		{
+			name:        "missing query parameter",
+			destination: "https://search.example.com/?q={q}",
+			query:       url.Values{"other": {"value"}},
+			invalid:     true,
+		},
+		{
+			name:          "unused path segments",
+			destination:   "https://jira.example.com/browse/{1}",
+			remainingPath: "/ABC-123/extra",
+			invalid:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filled, err := fillPlaceholders(test.destination, test.remainingPath, test.query)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", filled)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filled != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, filled)
+			}
+			if _, err := url.Parse(filled); err != nil {
+				t.Errorf("expected a valid URL, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFillPlaceholdersReportsPlaceholder(t *testing.T) {
+	_, err := fillPlaceholders("https://search.example.com/?q={q}", "", nil)
+	if !errors.Is(err, errPlaceholderValue) {
+		t.Fatalf("expected %v, got %v", errPlaceholderValue, err)
+	}
+	if err.Error() != "no valid value for placeholder {q}" {
+		t.Errorf("expected the placeholder in the error, got %q", err)
+	}
+}
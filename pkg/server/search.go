@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/julienschmidt/httprouter"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	searchResults     = 20
+	searchSuggestions = 10
+	// openSearchNameLength is the maximum length of the short name allowed by the OpenSearch specification
+	openSearchNameLength = 16
+)
+
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+// openSearch describes the search for browsers, so it can be added as search engine with a keyword shortcut
+func (s *Server) openSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	name := host
+	if len(name) > openSearchNameLength {
+		name = name[:openSearchNameLength]
+	}
+
+	base := ClientScheme(r) + "://" + r.Host
+	description := openSearchDescription{
+		ShortName:     name,
+		Description:   "Shortlinks on " + host,
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{{
+			Type:     "text/html",
+			Method:   "get",
+			Template: base + "/search?q={searchTerms}",
+		}, {
+			Type:     "application/x-suggestions+json",
+			Method:   "get",
+			Template: base + "/search/suggestions?q={searchTerms}",
+		}},
+	}
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	_, _ = w.Write([]byte(xml.Header))
+	err := xml.NewEncoder(w).Encode(description)
+	if err != nil {
+		log.Errorw("error writing opensearch description", "error", err)
+	}
+}
+
+// search redirects to the shortlink if the query is a code and lists the shortlinks matching the query otherwise.
+// Words of the query are path segments, "jira ABC-123" leads to /jira/ABC-123.
+func (s *Server) search(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := time.Now()
+	clientIP := ClientIP(r)
+	if wait := s.redirectLimiter.Allow(clientIP, now); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	domain := s.requestDomain(r.Host)
+
+	var results []searchResult
+	if query != "" {
+		path := strings.Join(strings.Fields(query), "/")
+		shortLink, remainingPath, _, err := s.resolvePath(r.Context(), domain, path)
+		if err != nil && err != persistence.ErrNotFound {
+			log.Errorw("error getting code", "domain", domain, "code", path, "error", err, "ip", clientIP)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		if err == nil && shortLink.IsActive(now) && (remainingPath == "" || shortLink.Passthrough || shortLink.Template) {
+			http.Redirect(w, r, (&url.URL{Path: "/" + path}).EscapedPath(), http.StatusFound)
+			return
+		}
+
+		if s.missBlocked(w, clientIP, now) {
+			return
+		}
+		results, err = s.searchShortlinks(r, domain, query, searchResults, now)
+		if err != nil {
+			log.Errorw("search error", "domain", domain, "query", query, "error", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+	}
+
+	err := templates["search.page.gohtml"].Execute(w, searchTemplateData{
+		Query:   query,
+		Results: results,
+	})
+	if err != nil {
+		log.Errorw("error rendering page", "url", r.URL.String(), "error", err)
+		http.Error(w, "Error rendering page", 500)
+	}
+}
+
+// searchSuggestions completes the query with codes in the OpenSearch suggestions format
+func (s *Server) searchSuggestions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := time.Now()
+	if wait := s.redirectLimiter.Allow(ClientIP(r), now); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	codes := []string{}
+	if query != "" {
+		results, err := s.searchShortlinks(r, s.requestDomain(r.Host), query, searchSuggestions, now)
+		if err != nil {
+			log.Errorw("search error", "query", query, "error", err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		for _, result := range results {
+			codes = append(codes, result.Code)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-suggestions+json")
+	err := json.NewEncoder(w).Encode([]interface{}{query, codes})
+	if err != nil {
+		log.Errorw("error writing suggestions", "error", err)
+	}
+}
+
+// searchShortlinks returns the active shortlinks matching the query that may be shown to the user. Internal shortlinks
+// are hidden from anonymous users, password protected ones are only found by their code and hide their destination.
+func (s *Server) searchShortlinks(r *http.Request, domain, query string, size int64, now time.Time) ([]searchResult, error) {
+	shortlinks, _, err := s.repo.GetEntries(r.Context(), persistence.Filter{Domain: domain, Search: query}, 0, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a configured authentication everyone may follow internal shortlinks
+	loggedIn := UserFromContext(r.Context()) != "" || ChallengeFromContext(r.Context()) == nil
+
+	var results []searchResult
+	for _, shortlink := range shortlinks {
+		if !shortlink.IsActive(now) || (shortlink.Internal && !loggedIn) {
+			continue
+		}
+
+		result := searchResult{
+			Code:  shortlink.Code,
+			Title: shortlink.Title,
+		}
+		if shortlink.PasswordHash != "" {
+			if !strings.Contains(strings.ToLower(shortlink.Code), strings.ToLower(query)) {
+				continue
+			}
+		} else {
+			result.Destination = shortlink.Destination(now)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
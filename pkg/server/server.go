@@ -2,12 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/julienschmidt/httprouter"
 	"github.com/patrick246/shortlink/pkg/observability/logging"
 	"github.com/patrick246/shortlink/pkg/persistence"
+	"github.com/patrick246/shortlink/pkg/ratelimit"
+	"github.com/patrick246/shortlink/pkg/validation"
+	"github.com/patrick246/shortlink/pkg/vars"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -15,10 +21,50 @@ var shutdownTimeout = 5 * time.Second
 
 var log = logging.CreateLogger("server")
 
+// SecuredPrefixes are the paths the authentication middleware has to protect
+var SecuredPrefixes = []string{"/admin/shortlinks", "/admin/trash", "/admin/namespaces"}
+
 type Server struct {
-	router *httprouter.Router
-	server http.Server
-	repo   persistence.Repository
+	router          *httprouter.Router
+	server          http.Server
+	repo            persistence.Repository
+	options         Options
+	redirectLimiter *ratelimit.Limiter
+	missLimiter     *ratelimit.Limiter
+	passwordLimiter *ratelimit.Limiter
+	suggestionCodes *codeList
+}
+
+type Options struct {
+	// DefaultRedirectStatus is used for shortlinks without their own redirect status
+	DefaultRedirectStatus int
+	URLPolicy             validation.Policy
+	// CookieSecret signs the cookies set after entering the password of a protected shortlink
+	CookieSecret []byte
+	// RedirectRateLimit limits all shortlink requests per client, MissRateLimit only the ones for unknown codes
+	RedirectRateLimit ratelimit.Policy
+	MissRateLimit     ratelimit.Policy
+	// PasswordRateLimit limits the wrong passwords of a client for a password protected shortlink
+	PasswordRateLimit ratelimit.Policy
+	// TrustedProxies may report the client address and scheme with forwarding headers
+	TrustedProxies []*net.IPNet
+	// PlainHTTPCookies leaves out the Secure attribute for plain HTTP requests that didn't pass a trusted proxy
+	PlainHTTPCookies bool
+	// TLSConfig enables HTTPS, HTTP/2 is negotiated automatically
+	TLSConfig *tls.Config
+	// HTTPRedirectAddr is an additional plain HTTP listener redirecting to HTTPS, it is disabled if empty
+	HTTPRedirectAddr string
+	// HTTPChallengeHandler wraps the redirect listener to answer ACME HTTP-01 challenges, it is optional
+	HTTPChallengeHandler func(fallback http.Handler) http.Handler
+	// Domains the shortlinks are served on, the first one is the default domain. Empty serves the same shortlinks on
+	// all hosts.
+	Domains []string
+	// CodeNormalization is applied to the codes of new shortlinks and to requested codes
+	CodeNormalization vars.Normalization
+	// CodeSuggestions is the maximum number of similar codes shown for unknown codes, 0 disables the suggestions
+	CodeSuggestions int
+	// Admins may manage all codes and the namespaces, groups are prefixed with group:. Without admins every user is one.
+	Admins []string
 }
 
 type MiddlewareFactory func(next http.Handler) http.Handler
@@ -27,15 +73,19 @@ func init() {
 	prometheus.MustRegister(codeUsageCounter)
 }
 
-func New(addr string, repo persistence.Repository, authMiddleware MiddlewareFactory) *Server {
+func New(addr string, repo persistence.Repository, authMiddleware MiddlewareFactory, options Options) *Server {
 	router := httprouter.New()
 
 	server := &Server{
-		repo:   repo,
-		router: router,
+		repo:            repo,
+		router:          router,
+		options:         options,
+		redirectLimiter: ratelimit.New("redirect", options.RedirectRateLimit),
+		missLimiter:     ratelimit.New("miss", options.MissRateLimit),
+		passwordLimiter: ratelimit.New("password", options.PasswordRateLimit),
+		suggestionCodes: &codeList{},
 		server: http.Server{
 			Addr:         addr,
-			Handler:      authMiddleware(router),
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		},
@@ -44,27 +94,74 @@ func New(addr string, repo persistence.Repository, authMiddleware MiddlewareFact
 	router.Handler(http.MethodGet, "/static/*filepath", http.FileServer(http.FS(staticContent)))
 	router.GET("/admin/shortlinks", server.listShortlinks)
 	router.POST("/admin/shortlinks", server.createOrEdit)
-	router.GET("/admin/shortlinks/:code", server.editShortlink)
-	router.POST("/admin/shortlinks/:code", server.createOrEdit)
-	router.POST("/admin/shortlinks/:code/delete", server.deleteShortlink)
+	// Codes can contain slashes, so they are passed as query parameter like the domain
+	router.GET("/admin/shortlinks/edit", server.editShortlink)
+	router.POST("/admin/shortlinks/edit", server.createOrEdit)
+	router.POST("/admin/shortlinks/delete", server.deleteShortlink)
+	router.POST("/admin/shortlinks/rollback", server.rollbackShortlink)
+	router.POST("/admin/shortlinks/aliases", server.addAlias)
+	router.POST("/admin/shortlinks/aliases/delete", server.deleteAlias)
+	router.GET("/admin/trash", server.listTrash)
+	router.POST("/admin/trash/restore", server.restoreShortlink)
+	router.POST("/admin/trash/purge", server.purgeShortlink)
+	router.GET("/admin/namespaces", server.listNamespaces)
+	router.POST("/admin/namespaces", server.saveNamespace)
+	router.POST("/admin/namespaces/delete", server.deleteNamespace)
 	router.Handler(http.MethodGet, "/admin/metrics", promhttp.Handler())
+	router.GET("/search", server.search)
+	router.GET("/search/suggestions", server.searchSuggestions)
+	router.GET("/opensearch.xml", server.openSearch)
 
 	router.NotFound = http.HandlerFunc(server.handleCodeRequests)
+	// The client is resolved first, authentication and rate limits need its address
+	server.server.Handler = server.resolveClient(authMiddleware(router))
 
 	return server
 }
 
 func (s *Server) ListenAndServe(ctx context.Context) error {
+	var redirectServer *http.Server
+	if s.options.TLSConfig != nil && s.options.HTTPRedirectAddr != "" {
+		var handler http.Handler = http.HandlerFunc(s.redirectToHTTPS)
+		if s.options.HTTPChallengeHandler != nil {
+			handler = s.options.HTTPChallengeHandler(handler)
+		}
+
+		redirectServer = &http.Server{
+			Addr:         s.options.HTTPRedirectAddr,
+			Handler:      handler,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Infow("listening for http redirects", "addr", redirectServer.Addr)
+			err := redirectServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Errorw("http redirect server error", "addr", redirectServer.Addr, "error", err)
+			}
+		}()
+	}
+
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 		log.Infow("shutting down server", "timeout", shutdownTimeout)
+		if redirectServer != nil {
+			_ = redirectServer.Shutdown(shutdownCtx)
+		}
 		_ = s.server.Shutdown(shutdownCtx)
 	}()
 
-	log.Infow("listening", "addr", s.server.Addr)
-	err := s.server.ListenAndServe()
+	var err error
+	if s.options.TLSConfig != nil {
+		s.server.TLSConfig = s.options.TLSConfig
+		log.Infow("listening", "addr", s.server.Addr, "tls", true)
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		log.Infow("listening", "addr", s.server.Addr)
+		err = s.server.ListenAndServe()
+	}
 	if err == http.ErrServerClosed {
 		time.Sleep(shutdownTimeout)
 	} else if err != nil {
@@ -72,3 +169,24 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 	}
 	return nil
 }
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS listener
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+
+	_, port, err := net.SplitHostPort(s.server.Addr)
+	if err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	target := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+}
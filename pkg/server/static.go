@@ -5,6 +5,7 @@ import (
 	"github.com/patrick246/shortlink/pkg/persistence"
 	"html/template"
 	"io/fs"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -17,17 +18,121 @@ var templateContent embed.FS
 
 type listTemplateData struct {
 	Shortlinks []persistence.Shortlink
+	// Aliases are grouped by persistence.Key of their target
+	Aliases map[string][]persistence.Alias
+	// Prefix filters the shortlinks by the start of their code
+	Prefix string
+	// Campaign filters the shortlinks by their campaign name
+	Campaign string
+	// NewCode prefills the code of the create form, e.g. from the link on the not found page
+	NewCode               string
+	Page                  int64
+	Total                 int64
+	Size                  int64
+	CSRF                  string
+	DefaultRedirectStatus int
+	Domains               []string
+	DefaultDomain         string
+}
+
+type trashTemplateData struct {
+	Shortlinks []persistence.TrashedShortlink
 	Page       int64
 	Total      int64
 	Size       int64
 	CSRF       string
+	Domains    []string
+}
+
+type namespacesTemplateData struct {
+	Namespaces []persistence.Namespace
+	CSRF       string
 }
 
 type editTemplateData struct {
-	Code string
-	URL  string
-	CSRF string
-	TTL  time.Time
+	Code                  string
+	URL                   string
+	CSRF                  string
+	TTL                   time.Time
+	ActiveFrom            time.Time
+	Schedule              []persistence.ScheduledDestination
+	Rules                 []persistence.Rule
+	Variants              []persistence.Variant
+	StickyVariants        bool
+	Campaign              persistence.Campaign
+	Revisions             []persistence.Revision
+	Aliases               []persistence.Alias
+	RedirectStatus        int
+	DefaultRedirectStatus int
+	Passthrough           bool
+	Template              bool
+	Title                 string
+	Interstitial          bool
+	Warning               string
+	HasPassword           bool
+	Internal              bool
+	Domain                string
+	Domains               []string
+
+	// ExistingCode is the stored code of the edited shortlink, empty if the shortlink hasn't been created yet
+	ExistingCode   string
+	ExistingDomain string
+	Errors         map[string]string
+}
+
+type previewTemplateData struct {
+	Code        string
+	Title       string
+	Destination string
+	TTL         time.Time
+	Warning     string
+}
+
+type notFoundTemplateData struct {
+	Code        string
+	Suggestions []string
+	// CreateURL links to the create form for the code, empty if the user may not create it
+	CreateURL string
+}
+
+type searchTemplateData struct {
+	Query   string
+	Results []searchResult
+}
+
+type searchResult struct {
+	Code  string
+	Title string
+	// Destination is empty for password protected shortlinks
+	Destination string
+}
+
+type passwordTemplateData struct {
+	Code  string
+	Title string
+	Error string
+}
+
+// codeSegment is a path segment of a hierarchical code, Prefix lists all codes below the segment
+type codeSegment struct {
+	Name   string
+	Prefix string
+	Last   bool
+}
+
+func codeSegments(code string) []codeSegment {
+	parts := strings.Split(code, "/")
+	segments := make([]codeSegment, 0, len(parts))
+	prefix := ""
+	for i, part := range parts {
+		prefix += part + "/"
+		segments = append(segments, codeSegment{
+			Name:   part,
+			Prefix: prefix,
+			Last:   i == len(parts)-1,
+		})
+	}
+	return segments
 }
 
 type pagination struct {
@@ -76,9 +181,25 @@ func init() {
 			"add": func(a, b int64) int64 {
 				return a + b
 			},
+			"statusText":   http.StatusText,
+			"key":          persistence.Key,
+			"codeSegments": codeSegments,
+			"redirectStatuses": func() []int {
+				return RedirectStatuses
+			},
+			"devices": func() []string {
+				return Devices
+			},
+			"campaignURL": func(destination string, campaign persistence.Campaign) string {
+				tagged, err := appendCampaign(destination, campaign)
+				if err != nil {
+					return destination
+				}
+				return tagged
+			},
 		})
 
-		template.Must(tmpl.Parse(string(content)))
+		// Bases are parsed first, so blocks defined by the page replace the defaults of the base
 		for _, base := range bases {
 			content, err := templateContent.ReadFile(base)
 			if err != nil {
@@ -86,6 +207,7 @@ func init() {
 			}
 			template.Must(tmpl.Parse(string(content)))
 		}
+		template.Must(tmpl.Parse(string(content)))
 
 		stripped := strings.TrimPrefix(page, "templates/")
 		templates[stripped] = tmpl
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// codeListRefresh is the maximum age of the codes suggested for unknown codes, the list is loaded on demand
+const codeListRefresh = time.Minute
+
+type suggestion struct {
+	code     string
+	distance int
+}
+
+// codeList keeps the codes of all shortlinks in memory, so unknown codes don't have to load all shortlinks each time
+type codeList struct {
+	sync.Mutex
+	loadedAt time.Time
+	// shortlinks only contain the fields needed to pick suggestions
+	shortlinks []persistence.Shortlink
+}
+
+// get returns the codes, they are reloaded if they are older than codeListRefresh. The previous codes are kept if the
+// reload fails.
+func (c *codeList) get(ctx context.Context, repo persistence.Repository, now time.Time) ([]persistence.Shortlink, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.shortlinks != nil && now.Sub(c.loadedAt) < codeListRefresh {
+		return c.shortlinks, nil
+	}
+
+	all, err := persistence.AllEntries(ctx, repo)
+	if err != nil {
+		return c.shortlinks, err
+	}
+
+	shortlinks := make([]persistence.Shortlink, 0, len(all))
+	for _, shortlink := range all {
+		shortlinks = append(shortlinks, persistence.Shortlink{
+			Domain:     shortlink.Domain,
+			Code:       shortlink.Code,
+			TTL:        shortlink.TTL,
+			ActiveFrom: shortlink.ActiveFrom,
+			Internal:   shortlink.Internal,
+		})
+	}
+	c.shortlinks = shortlinks
+	c.loadedAt = now
+	return shortlinks, nil
+}
+
+// unknownCode answers requests for codes that don't exist with similar codes and, if the user may manage the code, a
+// link to create it
+func (s *Server) unknownCode(w http.ResponseWriter, r *http.Request, domain, code string, now time.Time) {
+	if s.missBlocked(w, ClientIP(r), now) {
+		return
+	}
+
+	// Without a configured authentication everyone may use the admin area and follow internal shortlinks
+	loggedIn := UserFromContext(r.Context()) != "" || ChallengeFromContext(r.Context()) == nil
+
+	suggestions, err := s.suggestCodes(r.Context(), domain, code, loggedIn, now)
+	if err != nil {
+		log.Errorw("suggest codes error", "domain", domain, "code", code, "error", err)
+	}
+
+	data := notFoundTemplateData{
+		Code:        code,
+		Suggestions: suggestions,
+	}
+
+	newCode := s.options.CodeNormalization.Normalize(code)
+	if loggedIn && InvalidCode(newCode) == "" {
+		a, err := s.userAccess(r.Context())
+		if err != nil {
+			log.Errorw("get namespaces error", "error", err)
+		} else if a.mayManage(newCode) {
+			data.CreateURL = createPath(domain, newCode)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	err = templates["notfound.page.gohtml"].Execute(w, data)
+	if err != nil {
+		log.Errorw("error rendering page", "url", r.URL.String(), "error", err)
+	}
+}
+
+// suggestCodes finds the codes of active shortlinks on the domain that start with the requested code or are only a few
+// edits away from it, closest first. Internal shortlinks are only suggested if they could be followed. Codes created
+// within the last codeListRefresh might be missing.
+func (s *Server) suggestCodes(ctx context.Context, domain, code string, internal bool, now time.Time) ([]string, error) {
+	if s.options.CodeSuggestions == 0 {
+		return nil, nil
+	}
+
+	shortlinks, err := s.suggestionCodes.get(ctx, s.repo, now)
+	if shortlinks == nil {
+		return nil, err
+	}
+	if err != nil {
+		log.Errorw("reload codes error, suggesting the previous codes", "error", err)
+	}
+
+	requested := strings.ToLower(code)
+	maxDistance := len([]rune(requested)) / 3
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+
+	var suggestions []suggestion
+	for _, shortlink := range shortlinks {
+		if shortlink.Domain != domain || !shortlink.IsActive(now) || (shortlink.Internal && !internal) {
+			continue
+		}
+
+		candidate := strings.ToLower(shortlink.Code)
+		distance := editDistance(requested, candidate)
+		if distance <= maxDistance || strings.HasPrefix(candidate, requested) {
+			suggestions = append(suggestions, suggestion{code: shortlink.Code, distance: distance})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].code < suggestions[j].code
+	})
+	if len(suggestions) > s.options.CodeSuggestions {
+		suggestions = suggestions[:s.options.CodeSuggestions]
+	}
+
+	codes := make([]string, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		codes = append(codes, suggestion.code)
+	}
+	return codes, nil
+}
+
+// editDistance is the Levenshtein distance of the runes of a and b
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	previous := make([]int, len(br)+1)
+	current := make([]int, len(br)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		current[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(br)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
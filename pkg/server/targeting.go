@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Devices are the platforms rules can match, in the order they are detected. iOS and Android user agents also mention
+// macOS and Linux, so they are checked first.
+var Devices = []string{"ios", "android", "windows", "macos", "linux"}
+
+var deviceMarkers = map[string][]string{
+	"ios":     {"iphone", "ipad", "ipod"},
+	"android": {"android"},
+	"windows": {"windows"},
+	"macos":   {"macintosh", "mac os x"},
+	"linux":   {"linux", "x11"},
+}
+
+// targetDestination returns the destination of the first rule matching the request. Without a matching rule a variant
+// is chosen if the traffic is split, otherwise the scheduled destination is used. The variant is empty unless one has
+// been chosen.
+func targetDestination(w http.ResponseWriter, r *http.Request, shortLink persistence.Shortlink, now time.Time) (destination, variant string) {
+	if len(shortLink.Rules) != 0 {
+		device := deviceFamily(r.UserAgent())
+		language := preferredLanguage(r.Header.Get("Accept-Language"))
+		for _, rule := range shortLink.Rules {
+			if matchesRule(rule, device, language, r) {
+				return rule.URL, ""
+			}
+		}
+	}
+
+	if len(shortLink.Variants) != 0 {
+		chosen := chooseVariant(w, r, shortLink, now)
+		return chosen.URL, chosen.Name
+	}
+	return shortLink.Destination(now), ""
+}
+
+func matchesRule(rule persistence.Rule, device, language string, r *http.Request) bool {
+	if rule.Device != "" && rule.Device != device {
+		return false
+	}
+
+	if rule.Language != "" {
+		ruleLanguage := strings.ToLower(rule.Language)
+		if language != ruleLanguage && !strings.HasPrefix(language, ruleLanguage+"-") {
+			return false
+		}
+	}
+
+	if rule.Query != "" {
+		name, value := splitPair(rule.Query)
+		values, ok := r.URL.Query()[name]
+		if !ok {
+			return false
+		}
+		if strings.Contains(rule.Query, "=") && !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// deviceFamily detects the platform from the user agent, it is empty for unknown platforms
+func deviceFamily(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	for _, device := range Devices {
+		for _, marker := range deviceMarkers[device] {
+			if strings.Contains(userAgent, marker) {
+				return device
+			}
+		}
+	}
+	return ""
+}
+
+// preferredLanguage returns the language with the highest quality of an Accept-Language header in lower case, the
+// first one wins if several have the same quality
+func preferredLanguage(acceptLanguage string) string {
+	type weighted struct {
+		language string
+		quality  float64
+	}
+
+	var languages []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		language := strings.ToLower(strings.TrimSpace(fields[0]))
+		if language == "" || language == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			name, value := splitPair(param)
+			if name != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				quality = q
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, weighted{language: language, quality: quality})
+		}
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	return languages[0].language
+}
+
+// validateRule makes sure the rule has a known device and at least one condition, rules without conditions would hide
+// the schedule
+func validateRule(rule persistence.Rule) error {
+	if rule.Device != "" && !contains(Devices, rule.Device) {
+		return fmt.Errorf("unknown device %s", rule.Device)
+	}
+	if rule.Device == "" && rule.Language == "" && rule.Query == "" {
+		return errors.New("rules need at least one condition")
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	groupsContextKey
+	challengeContextKey
+	clientContextKey
+)
+
+// Challenge asks an unauthenticated client to log in, e.g. by redirecting to the identity provider
+type Challenge func(writer http.ResponseWriter, request *http.Request)
+
+// WithUser stores the name of the authenticated user, auth middlewares use it to pass the user to the handlers
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// WithLazyUser stores a function authenticating the user when the user is first needed, so credentials sent along with
+// public requests are only verified if a handler depends on the user. The result is kept for the request.
+func WithLazyUser(ctx context.Context, authenticate func() string) context.Context {
+	var once sync.Once
+	var user string
+	return context.WithValue(ctx, userContextKey, func() string {
+		once.Do(func() {
+			user = authenticate()
+		})
+		return user
+	})
+}
+
+func UserFromContext(ctx context.Context) string {
+	switch user := ctx.Value(userContextKey).(type) {
+	case string:
+		return user
+	case func() string:
+		return user()
+	}
+	return ""
+}
+
+// WithGroups stores the groups of the authenticated user reported by the identity provider
+func WithGroups(ctx context.Context, groups []string) context.Context {
+	return context.WithValue(ctx, groupsContextKey, groups)
+}
+
+func GroupsFromContext(ctx context.Context) []string {
+	groups, _ := ctx.Value(groupsContextKey).([]string)
+	return groups
+}
+
+// WithChallenge stores how unauthenticated clients can log in, it is nil if no authentication is configured
+func WithChallenge(ctx context.Context, challenge Challenge) context.Context {
+	return context.WithValue(ctx, challengeContextKey, challenge)
+}
+
+func ChallengeFromContext(ctx context.Context) Challenge {
+	challenge, _ := ctx.Value(challengeContextKey).(Challenge)
+	return challenge
+}
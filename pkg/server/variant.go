@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/patrick246/shortlink/pkg/persistence"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const variantCookiePrefix = "Variant-"
+
+var variantCookieLifetime = 30 * 24 * time.Hour
+
+// variantNamePattern keeps the names usable as metric labels and cookie values
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+var variantRandom = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// chooseVariant picks a variant by the weights. Sticky variants are remembered in a cookie, the cookie is ignored if its
+// variant has been removed in the meantime.
+func chooseVariant(w http.ResponseWriter, r *http.Request, shortLink persistence.Shortlink, now time.Time) persistence.Variant {
+	cookieName := variantCookieName(shortLink.Domain, shortLink.Code)
+	if shortLink.StickyVariants {
+		if cookie, err := Cookie(r, cookieName); err == nil {
+			for _, variant := range shortLink.Variants {
+				if variant.Name == cookie.Value {
+					return variant
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, variant := range shortLink.Variants {
+		total += variant.Weight
+	}
+	// Weights are validated when saving, but rolled back or migrated data might not have any
+	if total <= 0 {
+		log.Warnw("variants without weight, using the destination", "domain", shortLink.Domain, "code", shortLink.Code)
+		return persistence.Variant{URL: shortLink.Destination(now)}
+	}
+
+	variantRandom.Lock()
+	n := variantRandom.Intn(total)
+	variantRandom.Unlock()
+
+	chosen := shortLink.Variants[len(shortLink.Variants)-1]
+	for _, variant := range shortLink.Variants {
+		if n < variant.Weight {
+			chosen = variant
+			break
+		}
+		n -= variant.Weight
+	}
+
+	if shortLink.StickyVariants {
+		SetCookie(w, r, &http.Cookie{
+			Name:     cookieName,
+			Value:    chosen.Name,
+			Path:     "/",
+			Expires:  now.Add(variantCookieLifetime),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return chosen
+}
+
+// validateVariants makes sure a split has at least two variants with unique names and positive weights
+func validateVariants(variants []persistence.Variant) error {
+	if len(variants) == 1 {
+		return errors.New("a split needs at least two variants")
+	}
+
+	names := make(map[string]bool)
+	for _, variant := range variants {
+		if !variantNamePattern.MatchString(variant.Name) {
+			return fmt.Errorf("invalid name %q, allowed characters are A-Za-z0-9_-", variant.Name)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("duplicate name %s", variant.Name)
+		}
+		names[variant.Name] = true
+
+		if variant.Weight < 1 {
+			return fmt.Errorf("the weight of %s has to be at least 1", variant.Name)
+		}
+	}
+	return nil
+}
+
+// variantCookieName derives a cookie name from the domain and code, codes may contain characters not allowed in cookie
+// names
+func variantCookieName(domain, code string) string {
+	sum := sha256.Sum256([]byte(persistence.Key(domain, code)))
+	return variantCookiePrefix + hex.EncodeToString(sum[:8])
+}
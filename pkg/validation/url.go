@@ -0,0 +1,135 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrEmpty = errors.New("destination is required")
+var ErrNotAbsolute = errors.New("destination has to be an absolute URL including scheme and host")
+var ErrRedirectLoop = errors.New("destination points back to this shortlink server")
+
+// Policy describes which destination URLs are accepted for shortlinks
+type Policy struct {
+	AllowedSchemes []string
+	// AllowedHosts restricts destinations to matching hosts if not empty
+	AllowedHosts []HostMatcher
+	DeniedHosts  []HostMatcher
+}
+
+type HostMatcher interface {
+	Match(host string) bool
+	String() string
+}
+
+type suffixMatcher string
+
+// Match accepts the domain itself and all of its subdomains
+func (m suffixMatcher) Match(host string) bool {
+	suffix := string(m)
+	return host == suffix || strings.HasSuffix(host, "."+strings.TrimPrefix(suffix, "."))
+}
+
+func (m suffixMatcher) String() string {
+	return string(m)
+}
+
+type regexMatcher struct {
+	*regexp.Regexp
+}
+
+func (m regexMatcher) Match(host string) bool {
+	return m.MatchString(host)
+}
+
+// ParseHostMatchers parses a comma separated list of host patterns. Patterns prefixed with "regex:" are regular
+// expressions matched against the host, all other patterns match the domain and its subdomains.
+func ParseHostMatchers(patterns string) ([]HostMatcher, error) {
+	var matchers []HostMatcher
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if strings.HasPrefix(pattern, "regex:") {
+			re, err := regexp.Compile(strings.TrimPrefix(pattern, "regex:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+			}
+			matchers = append(matchers, regexMatcher{re})
+			continue
+		}
+		matchers = append(matchers, suffixMatcher(strings.ToLower(pattern)))
+	}
+	return matchers, nil
+}
+
+// ValidateURL checks a destination against the policy. ownHosts are the hosts the shortlink server is reachable at,
+// destinations pointing to them are rejected to prevent redirect loops.
+func (p Policy) ValidateURL(destination string, ownHosts ...string) error {
+	if destination == "" {
+		return ErrEmpty
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return fmt.Errorf("destination is not a valid URL: %w", err)
+	}
+
+	if !u.IsAbs() {
+		return ErrNotAbsolute
+	}
+
+	if !p.schemeAllowed(u.Scheme) {
+		return fmt.Errorf("scheme %q is not allowed, allowed schemes are %s", u.Scheme, strings.Join(p.AllowedSchemes, ", "))
+	}
+
+	if u.Hostname() == "" {
+		return ErrNotAbsolute
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, ownHost := range ownHosts {
+		if host == strings.ToLower(stripPort(ownHost)) {
+			return ErrRedirectLoop
+		}
+	}
+
+	for _, denied := range p.DeniedHosts {
+		if denied.Match(host) {
+			return fmt.Errorf("host %q is not allowed", host)
+		}
+	}
+
+	if len(p.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedHosts {
+		if allowed.Match(host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q is not in the list of allowed hosts", host)
+}
+
+func (p Policy) schemeAllowed(scheme string) bool {
+	for _, allowed := range p.AllowedSchemes {
+		if strings.EqualFold(allowed, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.Trim(hostport, "[]")
+	}
+	return host
+}
@@ -2,4 +2,13 @@ package vars
 
 import "regexp"
 
-var ValidCodePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~!$&'()*+,;=:@]+$`)
+// CodeCharacters are allowed in codes, hierarchical codes consist of several segments separated by slashes
+const CodeCharacters = `A-Za-z0-9\-._~!$&'()*+,;=:@`
+
+var ValidCodePattern = regexp.MustCompile(`^[` + CodeCharacters + `]+(/[` + CodeCharacters + `]+)*$`)
+
+// ReservedCodePrefixes are served by the admin area, the static files and the OIDC callback, codes can't start with them
+var ReservedCodePrefixes = []string{"admin/", "static/", "search/", "oauth2/"}
+
+// ReservedCodes are served by the search, codes can't be equal to them
+var ReservedCodes = []string{"search", "opensearch.xml"}
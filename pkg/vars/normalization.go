@@ -0,0 +1,74 @@
+package vars
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+)
+
+// trailingPunctuation is often copied along with a link at the end of a sentence
+const trailingPunctuation = ".,;:!?)'\""
+
+// Normalization makes codes that users type differently match the same shortlink. It is applied when a shortlink is
+// saved and when it is looked up.
+type Normalization struct {
+	CaseFolding     bool
+	TrimPunctuation bool
+	// Unicode applies NFKC normalization, e.g. full-width characters become their ASCII equivalent
+	Unicode bool
+}
+
+// ParseNormalization parses a comma separated list of the steps case, punctuation and unicode. Empty or none disables
+// the normalization.
+func ParseNormalization(value string) (Normalization, error) {
+	var n Normalization
+	for _, step := range strings.Split(value, ",") {
+		switch strings.TrimSpace(step) {
+		case "", "none":
+		case "case":
+			n.CaseFolding = true
+		case "punctuation":
+			n.TrimPunctuation = true
+		case "unicode":
+			n.Unicode = true
+		default:
+			return Normalization{}, fmt.Errorf("unknown normalization %q, possible values: case, punctuation, unicode", step)
+		}
+	}
+	return n, nil
+}
+
+func (n Normalization) Enabled() bool {
+	return n.CaseFolding || n.TrimPunctuation || n.Unicode
+}
+
+// String lists the enabled steps in the format of ParseNormalization
+func (n Normalization) String() string {
+	var steps []string
+	if n.CaseFolding {
+		steps = append(steps, "case")
+	}
+	if n.TrimPunctuation {
+		steps = append(steps, "punctuation")
+	}
+	if n.Unicode {
+		steps = append(steps, "unicode")
+	}
+	if len(steps) == 0 {
+		return "none"
+	}
+	return strings.Join(steps, ",")
+}
+
+func (n Normalization) Normalize(code string) string {
+	if n.Unicode {
+		code = norm.NFKC.String(code)
+	}
+	if n.CaseFolding {
+		code = strings.ToLower(code)
+	}
+	if n.TrimPunctuation {
+		code = strings.TrimRight(code, trailingPunctuation)
+	}
+	return code
+}
@@ -0,0 +1,71 @@
+package vars
+
+import "testing"
+
+func TestParseNormalization(t *testing.T) {
+	tests := []struct {
+		value         string
+		normalization Normalization
+		invalid       bool
+	}{
+		{value: "", normalization: Normalization{}},
+		{value: "none", normalization: Normalization{}},
+		{value: "case", normalization: Normalization{CaseFolding: true}},
+		{value: "case, punctuation", normalization: Normalization{CaseFolding: true, TrimPunctuation: true}},
+		{value: "unicode,case,punctuation", normalization: Normalization{CaseFolding: true, TrimPunctuation: true, Unicode: true}},
+		{value: "lowercase", invalid: true},
+		{value: "case;unicode", invalid: true},
+	}
+
+	for _, test := range tests {
+		normalization, err := ParseNormalization(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.value, normalization)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", test.value, err)
+			continue
+		}
+		if normalization != test.normalization {
+			t.Errorf("%q: expected %+v, got %+v", test.value, test.normalization, normalization)
+		}
+
+		// The string representation has to parse to the same normalization
+		reparsed, err := ParseNormalization(normalization.String())
+		if err != nil || reparsed != normalization {
+			t.Errorf("%q: expected %s to parse to %+v, got %+v, %v", test.value, normalization, normalization, reparsed, err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		normalization Normalization
+		code          string
+		expected      string
+	}{
+		{normalization: Normalization{}, code: "Meet.", expected: "Meet."},
+		{normalization: Normalization{CaseFolding: true}, code: "MeetUp", expected: "meetup"},
+		{normalization: Normalization{CaseFolding: true}, code: "ÄRGER", expected: "ärger"},
+		{normalization: Normalization{TrimPunctuation: true}, code: "meet).", expected: "meet"},
+		{normalization: Normalization{TrimPunctuation: true}, code: `"meet"`, expected: `"meet`},
+		{normalization: Normalization{TrimPunctuation: true}, code: "v1.2", expected: "v1.2"},
+		{normalization: Normalization{TrimPunctuation: true}, code: "...", expected: ""},
+		{normalization: Normalization{Unicode: true}, code: "ｍｅｅｔ", expected: "meet"},
+		{normalization: Normalization{Unicode: true}, code: "ﬁle", expected: "file"},
+		{normalization: Normalization{Unicode: true}, code: "Ａ", expected: "A"},
+		{normalization: Normalization{CaseFolding: true}, code: "ＭＥＥＴ", expected: "ｍｅｅｔ"},
+		{normalization: Normalization{CaseFolding: true, Unicode: true}, code: "ＭＥＥＴ", expected: "meet"},
+		{normalization: Normalization{CaseFolding: true, TrimPunctuation: true, Unicode: true}, code: "Ｍｅｅｔ！", expected: "meet"},
+	}
+
+	for _, test := range tests {
+		normalized := test.normalization.Normalize(test.code)
+		if normalized != test.expected {
+			t.Errorf("%s with %s: expected %q, got %q", test.code, test.normalization, test.expected, normalized)
+		}
+	}
+}